@@ -6,6 +6,7 @@ import (
 	"flag"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -17,6 +18,9 @@ import (
 	"github.com/vfaronov/nnbb/web"
 )
 
+// With the "relay" subcommand (nnbb relay -relay-addr ...), nnbb does not
+// serve the Web, but watches the DB for new posts and relays them to other
+// nnbb processes that are started with the same -relay-addr.
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
@@ -27,18 +31,73 @@ func main() {
 	var key string
 	flag.StringVar(&key, "key", "",
 		"secret key for cookie signing")
+	var backpressure string
+	flag.StringVar(&backpressure, "backpressure", "resync",
+		"`POLICY` for live updates to clients that don't keep up: "+
+			"close, resync, or coalesce")
+	var markdown string
+	flag.StringVar(&markdown, "markdown", web.DefaultMarkdownFeatures.String(),
+		"comma-separated Markdown `FEATURES` to enable: "+
+			"tables, strikethrough, autolinks, tasklists, newtab")
+	var blobURI string
+	flag.StringVar(&blobURI, "blob-uri", "",
+		"keep files attached to posts at `URI`: a directory (file:///path), "+
+			"GridFS in the MongoDB store (gridfs:), or mem: for transient "+
+			"in-memory storage (attachments are disabled if empty)")
+	var maxAttachmentSize int64
+	flag.Int64Var(&maxAttachmentSize, "max-attachment-size", 8<<20,
+		"maximum size of each file attached to a post, in `BYTES`")
+	var debugAddr string
+	flag.StringVar(&debugAddr, "debug-addr", "",
+		"address for serving internal counters at /debug/vars (off if empty)")
+	var relayAddr string
+	flag.StringVar(&relayAddr, "relay-addr", "",
+		"get new posts from the relay at `ADDR` (host:port or unix:/path) "+
+			"instead of watching the DB; with the relay subcommand, "+
+			"listen on ADDR")
 	flag.Parse()
 
+	if flag.Arg(0) == "relay" {
+		// Flags may also follow the subcommand.
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+		runRelay(relayAddr)
+		return
+	}
+
 	if key == "" {
 		log.Fatalf("no key for cookie signing")
 	}
+	policy, err := store.ParseBackpressure(backpressure)
+	if err != nil {
+		log.Fatal(err)
+	}
+	features, err := web.ParseMarkdownFeatures(markdown)
+	if err != nil {
+		log.Fatal(err)
+	}
+	web.SetMarkdownFeatures(features)
 
-	db, err := store.ConnectDB(context.Background(), config.StoreURI, true)
+	var broker store.Broker = store.NewLocalBroker()
+	if relayAddr != "" {
+		broker = store.NewRelayClient(relayAddr)
+	}
+	db, err := store.ConnectDB(context.Background(), config.StoreURI, broker)
 	if err != nil {
 		log.Fatalf("failed to connect to storage DB: %v", err)
 	}
 	svr := web.NewServer(webAddr, db, []byte(key))
+	svr.Backpressure = policy
+	if blobURI != "" {
+		svr.Blobs, err = store.ConnectBlobStore(context.Background(), blobURI, db)
+		if err != nil {
+			log.Fatalf("failed to connect to blob store: %v", err)
+		}
+		svr.MaxAttachmentSize = maxAttachmentSize
+	}
 
+	if debugAddr != "" {
+		go runDebugServer(debugAddr)
+	}
 	go runServer(svr)
 	handleSignals(svr, db)
 }
@@ -50,7 +109,39 @@ func runServer(svr *web.Server) {
 	}
 }
 
-func handleSignals(svr *web.Server, db *store.DB) {
+func runRelay(addr string) {
+	if addr == "" {
+		log.Fatalf("no -relay-addr to listen on")
+	}
+	broker := store.NewLocalBroker()
+	db, err := store.ConnectDB(context.Background(), config.StoreURI, broker)
+	if err != nil {
+		log.Fatalf("failed to connect to storage DB: %v", err)
+	}
+	l, err := net.Listen(store.SplitRelayAddr(addr))
+	if err != nil {
+		log.Fatalf("failed to listen for relay clients: %v", err)
+	}
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-ch
+		log.Printf("shutting down relay due to signal: %v", sig)
+		l.Close()
+	}()
+	err = store.ServeRelay(l, broker)
+	log.Printf("relay quit: %v", err)
+	db.Disconnect(context.Background())
+}
+
+// runDebugServer serves http.DefaultServeMux, where package expvar
+// registers its handler.
+func runDebugServer(addr string) {
+	log.Printf("starting debug server on %v", addr)
+	log.Printf("debug server quit: %v", http.ListenAndServe(addr, nil)) //nolint:gosec
+}
+
+func handleSignals(svr *web.Server, db store.Store) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-ch
@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"log"
+	"strings"
 
 	"github.com/vfaronov/nnbb/config"
 	"github.com/vfaronov/nnbb/store"
@@ -20,11 +21,14 @@ func main() {
 	flag.IntVar(&insertFake, "insert-fake", 0,
 		"insert fake data into the database with amount `FACTOR` "+
 			"(100 is good for development)")
+	var setRole string
+	flag.StringVar(&setRole, "set-role", "",
+		"give user `NAME=ROLE`, where ROLE is one of: user, moderator, admin")
 	flag.Parse()
 
 	ctx := context.Background()
 
-	db, err := store.ConnectDB(ctx, config.StoreURI, false)
+	db, err := store.ConnectDB(ctx, config.StoreURI, nil)
 	if err != nil {
 		log.Fatalf("failed to connect to storage DB: %v", err)
 	}
@@ -43,4 +47,27 @@ func main() {
 			log.Fatalf("failed to insert fake data: %v", err)
 		}
 	}
+	if setRole != "" {
+		i := strings.LastIndexByte(setRole, '=')
+		if i < 0 {
+			log.Fatalf("bad -set-role: %q: expected NAME=ROLE", setRole)
+		}
+		name := setRole[:i]
+		role, err := store.ParseRole(setRole[i+1:])
+		if err != nil {
+			log.Fatalf("bad -set-role: %v", err)
+		}
+		if err := db.SetRole(ctx, name, role); err != nil {
+			log.Fatalf("failed to set role of %q: %v", name, err)
+		}
+		err = db.LogModAction(ctx, &store.ModAction{
+			Moderator: "nnbbtool",
+			Action:    store.ModSetRole,
+			User:      name,
+			Note:      role.String(),
+		})
+		if err != nil {
+			log.Fatalf("failed to log role change: %v", err)
+		}
+	}
 }
@@ -14,7 +14,9 @@ var (
 func WithStoreURI() {
 	flag.StringVar(&StoreURI, "store-uri",
 		"mongodb://localhost:27017/nnbb?replicaSet=nnbb",
-		"connect to MongoDB at `URI` (must include DB name and replica set)")
+		"connect to storage at `URI`: MongoDB (must include DB name "+
+			"and replica set), PostgreSQL (postgres://...), "+
+			"or mem:// for a transient in-memory store")
 }
 
 func WithFakeData() {
@@ -5,12 +5,16 @@ go 1.16
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
 	github.com/brianvoe/gofakeit v3.18.0+incompatible
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/headzoo/surf v1.0.0
 	github.com/headzoo/ut v0.0.0-20181013193318-a13b5a7a02ca // indirect
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
 	github.com/yuin/goldmark v1.3.3
 	go.mongodb.org/mongo-driver v1.5.1
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 	gopkg.in/headzoo/surf.v1 v1.0.0
 )
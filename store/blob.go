@@ -0,0 +1,320 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Attachment is a file attached to a post.
+type Attachment struct {
+	Name string // as uploaded, for display only
+	Type string // MIME type, without parameters
+	Size int64
+	Blob string // key of the contents in the BlobStore
+	// Thumb is the key of a smaller version of an image, if any.
+	Thumb string `bson:",omitempty"`
+}
+
+// IsImage reports whether a can be displayed as an image.
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.Type, "image/")
+}
+
+// BlobStore keeps the contents of attachments. Blobs are content-addressed:
+// the key of a blob is the hex-encoded SHA-256 of its data, so storing
+// the same data twice stores it once, and a blob never changes.
+// Several posts may share a blob, so deleting a post doesn't delete
+// its blobs. Instead, a blob should only be served while
+// Store.HasAttachment reports it, so that deleting the posts
+// that have it takes it down.
+// TODO: garbage-collect blobs that no post refers to.
+type BlobStore interface {
+	// PutBlob stores data and returns its key.
+	PutBlob(ctx context.Context, data []byte) (string, error)
+	// GetBlob returns ErrNotFound if there is no blob with key.
+	GetBlob(ctx context.Context, key string) ([]byte, error)
+	// DeleteBlob deletes the blob with key, if any. It must only be
+	// called for blobs that no post has.
+	DeleteBlob(ctx context.Context, key string) error
+}
+
+func (db *DB) HasAttachment(ctx context.Context, blob string) (bool, error) {
+	n, err := db.posts.CountDocuments(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"attachments.blob": blob},
+			bson.M{"attachments.thumb": blob},
+		}},
+		options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// ConnectBlobStore returns a BlobStore for the given uri, chosen by its
+// scheme: file:///path for a directory in the local filesystem,
+// gridfs: for a GridFS bucket in the same database as db (which must be
+// a MongoDB store), mem: for an in-memory store whose data is lost
+// when the process exits.
+func ConnectBlobStore(ctx context.Context, uri string, db Store) (BlobStore, error) {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("store: bad blob URI: %q: %w", uri, err)
+	}
+	switch parsedURI.Scheme {
+	case "file":
+		return NewFSBlobStore(parsedURI.Path)
+	case "gridfs":
+		mongoDB, ok := db.(*DB)
+		if !ok {
+			return nil, fmt.Errorf("store: GridFS requires a MongoDB store")
+		}
+		return &GridFSBlobStore{db: mongoDB.posts.Database()}, nil
+	case "mem":
+		return NewMemBlobStore(), nil
+	default:
+		return nil, fmt.Errorf("store: unsupported blob URI scheme: %q", uri)
+	}
+}
+
+// blobKey returns the key of data.
+func blobKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// isBlobKey reports whether key may have been returned by blobKey.
+// Keys come from URLs, so this also keeps them from escaping
+// the directory of an FSBlobStore.
+func isBlobKey(key string) bool {
+	if len(key) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range key {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// FSBlobStore is a BlobStore that keeps each blob in a file
+// under a directory in the local filesystem.
+type FSBlobStore struct {
+	dir string
+}
+
+// NewFSBlobStore returns an FSBlobStore in dir, creating it if needed.
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	if dir == "" {
+		return nil, errors.New("store: no directory for blobs")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	log.Printf("store: keeping blobs in %v", dir)
+	return &FSBlobStore{dir: dir}, nil
+}
+
+// path returns the name of the file for key. Blobs are spread across
+// subdirectories by the first two characters of their keys.
+func (bs *FSBlobStore) path(key string) string {
+	return filepath.Join(bs.dir, key[:2], key)
+}
+
+func (bs *FSBlobStore) PutBlob(ctx context.Context, data []byte) (string, error) {
+	key := blobKey(data)
+	path := bs.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return key, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	// Write to a temporary file and rename it into place, so that
+	// a blob is never seen half-written. Concurrent writers of the same
+	// blob write the same data, so either of them may win.
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (bs *FSBlobStore) GetBlob(ctx context.Context, key string) ([]byte, error) {
+	if !isBlobKey(key) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(bs.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (bs *FSBlobStore) DeleteBlob(ctx context.Context, key string) error {
+	if !isBlobKey(key) {
+		return nil
+	}
+	err := os.Remove(bs.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// GridFSBlobStore is a BlobStore that keeps blobs in the GridFS bucket
+// "blobs" of a MongoDB database, with their keys as file names.
+type GridFSBlobStore struct {
+	db *mongo.Database
+}
+
+// bucket returns the bucket with deadlines from ctx. A new bucket
+// is made for every operation because deadlines are set on the bucket.
+func (bs *GridFSBlobStore) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(bs.db, options.GridFSBucket().SetName("blobs"))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := bucket.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if err := bucket.SetWriteDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+func (bs *GridFSBlobStore) PutBlob(ctx context.Context, data []byte) (string, error) {
+	key := blobKey(data)
+	bucket, err := bs.bucket(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Concurrent writers of the same blob may both get past this check
+	// and store it twice under the same name, which is harmless:
+	// GetBlob returns either copy.
+	n, err := bs.db.Collection("blobs.files").CountDocuments(ctx,
+		bson.M{"filename": key}, options.Count().SetLimit(1))
+	if err != nil {
+		return "", err
+	}
+	if n > 0 {
+		return key, nil
+	}
+	if _, err := bucket.UploadFromStream(key, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func (bs *GridFSBlobStore) GetBlob(ctx context.Context, key string) ([]byte, error) {
+	if !isBlobKey(key) {
+		return nil, ErrNotFound
+	}
+	bucket, err := bs.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = bucket.DownloadToStreamByName(key, &buf)
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (bs *GridFSBlobStore) DeleteBlob(ctx context.Context, key string) error {
+	if !isBlobKey(key) {
+		return nil
+	}
+	bucket, err := bs.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	// There may be several copies (see PutBlob).
+	cur, err := bucket.Find(bson.M{"filename": key})
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cur.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := bucket.Delete(f.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemBlobStore is a BlobStore that keeps blobs in memory.
+type MemBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewMemBlobStore() *MemBlobStore {
+	return &MemBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (bs *MemBlobStore) PutBlob(ctx context.Context, data []byte) (string, error) {
+	key := blobKey(data)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.blobs[key] == nil {
+		bs.blobs[key] = append([]byte(nil), data...)
+	}
+	return key, nil
+}
+
+func (bs *MemBlobStore) GetBlob(ctx context.Context, key string) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	data := bs.blobs[key]
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (bs *MemBlobStore) DeleteBlob(ctx context.Context, key string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	delete(bs.blobs, key)
+	return nil
+}
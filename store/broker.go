@@ -0,0 +1,56 @@
+package store
+
+import (
+	"sync"
+)
+
+// A Broker carries events about new posts from wherever they are observed
+// to the pump that dispatches them to listeners (see StreamRoom).
+//
+// Normally, each process watches the database for new posts itself,
+// through a LocalBroker. To avoid multiplying the load on the database when
+// running many processes, a single relay process can do the watching instead
+// (see ServeRelay), with the other processes using a RelayClient.
+type Broker interface {
+	// Subscribe returns a channel that will receive all events passing
+	// through the broker. Subscribers must read the channel promptly.
+	// If any events may have been lost, the channel receives a Resync event.
+	Subscribe() <-chan Event
+}
+
+// A Publisher is a Broker that is fed events by the current process.
+// A Store that is given a Publisher watches the database for new posts
+// and publishes them. A Store that is given any other Broker does not watch
+// the database, relying on the Broker to provide the events.
+type Publisher interface {
+	Broker
+	Publish(ev Event)
+}
+
+// LocalBroker is a Publisher that delivers events within the current process.
+type LocalBroker struct {
+	mu   sync.Mutex
+	subs []chan Event
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Subscribe() <-chan Event {
+	ch := make(chan Event, 16)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+// Publish delivers ev to all subscribers, blocking until each of them
+// has room for it.
+func (b *LocalBroker) Publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		ch <- ev
+	}
+}
@@ -68,10 +68,17 @@ func NewFaker(path string) (Faker, error) {
 	return fk, nil
 }
 
+// fakeInserter is implemented by every Store to let Faker insert backdated
+// posts and rooms directly, bypassing the invariants of CreatePost.
+type fakeInserter interface {
+	insertFakePost(ctx context.Context, post *Post) error
+	replaceFakeRoom(ctx context.Context, room *Room) error
+}
+
 // Insert generates and inserts fake data into db, spanning some recent
 // time range. Exactly factor rooms will be created; the number of posts
 // and the length of the time range also increases with factor.
-func (fk Faker) Insert(ctx context.Context, db *DB, factor int) error {
+func (fk Faker) Insert(ctx context.Context, db Store, factor int) error {
 	// TODO: fake users
 	for i := 0; i < factor; i++ {
 		if err := fk.insertFakeRoom(ctx, db, factor); err != nil {
@@ -81,7 +88,7 @@ func (fk Faker) Insert(ctx context.Context, db *DB, factor int) error {
 	return nil
 }
 
-func (fk Faker) insertFakeRoom(ctx context.Context, db *DB, factor int) error {
+func (fk Faker) insertFakeRoom(ctx context.Context, db Store, factor int) error {
 	room := &Room{
 		Title:  fk.RoomTitle(),
 		Author: fk.UserName(),
@@ -115,7 +122,7 @@ func (fk Faker) insertFakeRoom(ctx context.Context, db *DB, factor int) error {
 		post.Serial++
 		post.Author = fk.UserName()
 		post.Text = fk.PostText()
-		_, err := db.posts.InsertOne(ctx, post)
+		err := db.(fakeInserter).insertFakePost(ctx, post)
 		if err != nil {
 			return err
 		}
@@ -124,7 +131,7 @@ func (fk Faker) insertFakeRoom(ctx context.Context, db *DB, factor int) error {
 	// Update room info to reflect the last post.
 	room.Updated = post.Time
 	room.Serial = post.Serial
-	_, err := db.rooms.ReplaceOne(ctx, bson.M{"_id": room.ID}, room)
+	err := db.(fakeInserter).replaceFakeRoom(ctx, room)
 	if err != nil {
 		return err
 	}
@@ -168,3 +175,13 @@ func (fk Faker) PostText() string {
 func oneOf(ss ...string) string {
 	return ss[rand.Intn(len(ss))]
 }
+
+func (db *DB) insertFakePost(ctx context.Context, post *Post) error {
+	_, err := db.posts.InsertOne(ctx, post)
+	return err
+}
+
+func (db *DB) replaceFakeRoom(ctx context.Context, room *Room) error {
+	_, err := db.rooms.ReplaceOne(ctx, bson.M{"_id": room.ID}, room)
+	return err
+}
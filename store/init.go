@@ -9,9 +9,22 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// InitDB initializes collections and indexes in db.
-// If any of the indexes already exists, InitDB returns an error.
-func InitDB(ctx context.Context, db *DB) error {
+// InitDB initializes collections and indexes in s.
+// If any of the collections (tables) or indexes already exists,
+// InitDB returns an error.
+// A MemDB needs no initialization.
+func InitDB(ctx context.Context, s Store) error {
+	switch db := s.(type) {
+	case *DB:
+		return initMongo(ctx, db)
+	case *PgDB:
+		return initPostgres(ctx, db)
+	default:
+		return nil
+	}
+}
+
+func initMongo(ctx context.Context, db *DB) error {
 	var err error
 
 	log.Print("store: creating index for users")
@@ -25,20 +38,73 @@ func InitDB(ctx context.Context, db *DB) error {
 		return err
 	}
 
-	log.Print("store: creating index for rooms")
-	_, err = db.rooms.Indexes().CreateOne(ctx,
+	log.Print("store: creating indexes for rooms")
+	// One for each RoomOrder.
+	_, err = db.rooms.Indexes().CreateMany(ctx,
+		[]mongo.IndexModel{
+			{Keys: bson.D{{Key: "updated", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "serial", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.D{{Key: "title", Value: 1}, {Key: "_id", Value: 1}}},
+			{Keys: bson.M{"title": "text"}}, // for Search
+			{Keys: bson.M{"author": 1}},     // for GetProfile
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Print("store: creating indexes for posts")
+	_, err = db.posts.Indexes().CreateMany(ctx,
+		[]mongo.IndexModel{
+			{
+				Keys:    bson.M{"roomId": 1, "serial": 1},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.M{"text": "text"}}, // for Search
+			{ // for GetProfile and GetPostsByAuthor
+				Keys: bson.D{
+					{Key: "author", Value: 1},
+					{Key: "time", Value: 1},
+					{Key: "_id", Value: 1},
+				},
+			},
+			{ // for GetPostsMentioning
+				Keys: bson.D{
+					{Key: "mentions", Value: 1},
+					{Key: "time", Value: 1},
+					{Key: "_id", Value: 1},
+				},
+			},
+			{ // for HasAttachment
+				Keys:    bson.M{"attachments.blob": 1},
+				Options: options.Index().SetSparse(true),
+			},
+			{
+				Keys:    bson.M{"attachments.thumb": 1},
+				Options: options.Index().SetSparse(true),
+			},
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Print("store: creating index for read markers")
+	_, err = db.reads.Indexes().CreateOne(ctx,
 		mongo.IndexModel{
-			Keys: bson.M{"updated": 1},
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "roomId", Value: 1}},
+			Options: options.Index().SetUnique(true),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	log.Print("store: creating index for posts")
-	_, err = db.posts.Indexes().CreateOne(ctx,
+	log.Print("store: creating index for watches")
+	_, err = db.watches.Indexes().CreateOne(ctx,
 		mongo.IndexModel{
-			Keys:    bson.M{"roomId": 1, "serial": 1},
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "roomId", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
 	)
@@ -46,5 +112,13 @@ func InitDB(ctx context.Context, db *DB) error {
 		return err
 	}
 
+	log.Print("store: creating index for moderation log")
+	_, err = db.modlog.Indexes().CreateOne(ctx,
+		mongo.IndexModel{Keys: bson.M{"time": 1}},
+	)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
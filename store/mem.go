@@ -0,0 +1,702 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemDB is a Store that keeps all data in memory of the current process.
+// It needs no external services, which makes it handy for development and
+// testing, but all data is lost when the process exits.
+type MemDB struct {
+	mu        sync.RWMutex
+	users     map[string]*User // by name
+	rooms     map[primitive.ObjectID]*Room
+	posts     map[primitive.ObjectID][]*Post           // by room ID, in order of serial
+	reads     map[string]map[primitive.ObjectID]uint64 // by user name, room ID
+	watches   map[string]map[primitive.ObjectID]bool   // by user name, room ID
+	modlog    []*ModAction                             // oldest first
+	publisher Publisher                                // nil if not streaming
+	*pump
+}
+
+// NewMemDB returns an empty MemDB. If broker is not nil, the returned MemDB
+// also runs a background goroutine that enables streaming new posts
+// via StreamRoom. Because nobody else can see the data in a MemDB,
+// broker must be a Publisher.
+func NewMemDB(broker Broker) (*MemDB, error) {
+	log.Print("store: using in-memory storage")
+	db := &MemDB{
+		users:   make(map[string]*User),
+		rooms:   make(map[primitive.ObjectID]*Room),
+		posts:   make(map[primitive.ObjectID][]*Post),
+		reads:   make(map[string]map[primitive.ObjectID]uint64),
+		watches: make(map[string]map[primitive.ObjectID]bool),
+	}
+	if broker != nil {
+		pub, ok := broker.(Publisher)
+		if !ok {
+			return nil, fmt.Errorf("store: in-memory storage cannot stream from %T", broker)
+		}
+		db.publisher = pub
+		db.pump = newPump(broker)
+	}
+	return db, nil
+}
+
+func (db *MemDB) Disconnect(ctx context.Context) {
+	log.Print("store: discarding in-memory storage")
+}
+
+func (db *MemDB) CreateRoom(ctx context.Context, room *Room) error {
+	room.ID = primitive.NewObjectID()
+	room.Created = time.Now()
+	room.Updated = room.Created
+	room.Serial = 0
+	stored := *room
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.rooms[room.ID] = &stored
+	return nil
+}
+
+func (db *MemDB) GetRoom(ctx context.Context, id primitive.ObjectID) (*Room, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := db.rooms[id]
+	if stored == nil {
+		return nil, nil
+	}
+	room := *stored
+	return &room, nil
+}
+
+func (db *MemDB) GetRoomsByID(
+	ctx context.Context,
+	ids []primitive.ObjectID,
+) (map[primitive.ObjectID]*Room, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	rooms := make(map[primitive.ObjectID]*Room, len(ids))
+	for _, id := range ids {
+		if stored := db.rooms[id]; stored != nil {
+			room := *stored
+			rooms[id] = &room
+		}
+	}
+	return rooms, nil
+}
+
+func (db *MemDB) GetRooms(
+	ctx context.Context,
+	order RoomOrder,
+	cursor string,
+	n int64,
+) ([]*Room, error) {
+	var after *Room
+	if cursor != "" {
+		var err error
+		if after, err = order.parseCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	// There's no index, so just sort them all. Good enough for testing.
+	db.mu.RLock()
+	rooms := make([]*Room, 0, len(db.rooms))
+	for _, stored := range db.rooms {
+		if after != nil && !order.before(after, stored) {
+			continue
+		}
+		room := *stored
+		rooms = append(rooms, &room)
+	}
+	db.mu.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return order.before(rooms[i], rooms[j])
+	})
+	if int64(len(rooms)) > n {
+		rooms = rooms[:n]
+	}
+	return rooms, nil
+}
+
+func (db *MemDB) UpdateRoom(ctx context.Context, room *Room) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.rooms[room.ID]
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.Title = room.Title
+	stored.Description = room.Description
+	stored.Updated = time.Now()
+	*room = *stored
+	if db.publisher != nil {
+		published := *stored
+		db.publisher.Publish(Event{Type: RoomUpdated, Room: &published})
+	}
+	return nil
+}
+
+func (db *MemDB) SetRoomState(ctx context.Context, room *Room, state RoomState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.rooms[room.ID]
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.State = state
+	*room = *stored
+	if db.publisher != nil {
+		published := *stored
+		db.publisher.Publish(Event{Type: RoomUpdated, Room: &published})
+	}
+	return nil
+}
+
+func (db *MemDB) CreatePost(ctx context.Context, post *Post) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	room := db.rooms[post.RoomID]
+	if room == nil {
+		return ErrNotFound
+	}
+	if room.State != RoomOpen {
+		return &RoomClosedError{room.State}
+	}
+	if post.ReplyTo > room.Serial {
+		return ErrBadReply
+	}
+	post.Mentions = onlyExisting(ParseMentions(post.Text), func(name string) bool {
+		return db.users[name] != nil
+	})
+	post.ID = primitive.NewObjectID()
+	post.Time = time.Now()
+	room.Serial++
+	room.Updated = post.Time
+	post.Serial = room.Serial
+	stored := *post
+	db.posts[room.ID] = append(db.posts[room.ID], &stored)
+	if db.publisher != nil {
+		// Publish while still holding the lock, so that listeners
+		// receive posts in the order of their serial numbers.
+		published := stored
+		db.publisher.Publish(Event{Type: PostCreated, Post: &published})
+	}
+	return nil
+}
+
+// findPost returns the stored post with serial in roomID, or nil.
+// db.mu must be held.
+func (db *MemDB) findPost(roomID primitive.ObjectID, serial uint64) *Post {
+	stored := db.posts[roomID]
+	i := sort.Search(len(stored), func(i int) bool {
+		return stored[i].Serial >= serial
+	})
+	if i == len(stored) || stored[i].Serial != serial {
+		return nil
+	}
+	return stored[i]
+}
+
+func (db *MemDB) GetPost(ctx context.Context, room *Room, serial uint64) (*Post, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := db.findPost(room.ID, serial)
+	if stored == nil {
+		return nil, ErrNotFound
+	}
+	post := *stored
+	post.Revisions = append([]Revision(nil), stored.Revisions...)
+	return &post, nil
+}
+
+func (db *MemDB) EditPost(ctx context.Context, post *Post, editor, text string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.findPost(post.RoomID, post.Serial)
+	if stored == nil || !stored.Deleted.IsZero() {
+		return ErrNotFound
+	}
+	stored.Revisions = append(stored.Revisions, stored.current())
+	stored.Text = text
+	stored.Edited = time.Now()
+	stored.Editor = editor
+	*post = *stored
+	post.Revisions = append([]Revision(nil), stored.Revisions...)
+	if db.publisher != nil {
+		published := *stored
+		published.Revisions = nil
+		db.publisher.Publish(Event{Type: PostEdited, Post: &published})
+	}
+	return nil
+}
+
+func (db *MemDB) DeletePost(ctx context.Context, post *Post, deleter string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.findPost(post.RoomID, post.Serial)
+	if stored == nil {
+		return ErrNotFound
+	}
+	if stored.Deleted.IsZero() {
+		stored.Text = ""
+		stored.Revisions = nil
+		stored.Reactions = nil
+		stored.Attachments = nil
+		stored.Deleted = time.Now()
+		stored.Deleter = deleter
+		if db.publisher != nil {
+			published := *stored
+			db.publisher.Publish(Event{Type: PostDeleted, Post: &published})
+		}
+	}
+	*post = *stored
+	return nil
+}
+
+func (db *MemDB) ToggleReaction(ctx context.Context, post *Post, user, emoji string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.findPost(post.RoomID, post.Serial)
+	if stored == nil || !stored.Deleted.IsZero() {
+		return false, ErrNotFound
+	}
+	reaction := Reaction{User: user, Emoji: emoji}
+	// Copy on write, because published events share the slice.
+	reactions := make([]Reaction, 0, len(stored.Reactions)+1)
+	added := true
+	for _, r := range stored.Reactions {
+		if r == reaction {
+			added = false
+		} else {
+			reactions = append(reactions, r)
+		}
+	}
+	if added {
+		reactions = append(reactions, reaction)
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+	stored.Reactions = reactions
+	*post = *stored
+	post.Revisions = nil
+	if db.publisher != nil {
+		published := *post
+		db.publisher.Publish(Event{Type: PostReacted, Post: &published})
+	}
+	return added, nil
+}
+
+func (db *MemDB) HasAttachment(ctx context.Context, blob string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, posts := range db.posts {
+		for _, post := range posts {
+			for _, att := range post.Attachments {
+				if att.Blob == blob || att.Thumb == blob {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func (db *MemDB) GetPostsSince(
+	ctx context.Context,
+	room *Room,
+	since uint64,
+	n int64,
+) ([]*Post, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := db.posts[room.ID]
+	i := sort.Search(len(stored), func(i int) bool {
+		return stored[i].Serial > since
+	})
+	stored = stored[i:]
+	if n > 0 && int64(len(stored)) > n {
+		stored = stored[:n]
+	}
+	return copyPosts(room, stored), nil
+}
+
+func (db *MemDB) GetPostsBefore(
+	ctx context.Context,
+	room *Room,
+	before uint64,
+	n int64,
+) ([]*Post, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := db.posts[room.ID]
+	i := sort.Search(len(stored), func(i int) bool {
+		return stored[i].Serial >= before
+	})
+	stored = stored[:i]
+	if int64(len(stored)) > n {
+		stored = stored[int64(len(stored))-n:]
+	}
+	return copyPosts(room, stored), nil
+}
+
+// copyPosts returns copies of stored posts, so that the caller may modify them
+// without holding the lock.
+func copyPosts(room *Room, stored []*Post) []*Post {
+	posts := make([]*Post, len(stored))
+	for i, p := range stored {
+		post := *p
+		post.Revisions = nil
+		posts[i] = &post
+		room.fixup(&post)
+	}
+	return posts
+}
+
+// Search matches q.Text as a case-insensitive substring. Results are ordered
+// by time, newest first, rather than by relevance.
+func (db *MemDB) Search(ctx context.Context, q *SearchQuery, n int64) (*SearchResults, error) {
+	text := strings.ToLower(q.Text)
+	matches := func(s, author string, t time.Time) bool {
+		return (q.Author == "" || author == q.Author) &&
+			(q.Since.IsZero() || !t.Before(q.Since)) &&
+			(q.Until.IsZero() || t.Before(q.Until)) &&
+			strings.Contains(strings.ToLower(s), text)
+	}
+	res := &SearchResults{}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if q.RoomID.IsZero() {
+		for _, stored := range db.rooms {
+			if matches(stored.Title, stored.Author, stored.Created) {
+				room := *stored
+				res.Rooms = append(res.Rooms, &room)
+			}
+		}
+	}
+	for roomID, stored := range db.posts {
+		if !q.RoomID.IsZero() && roomID != q.RoomID {
+			continue
+		}
+		for _, p := range stored {
+			if matches(p.Text, p.Author, p.Time) {
+				post := *p
+				post.Revisions = nil
+				res.Posts = append(res.Posts, &post)
+			}
+		}
+	}
+	sort.Slice(res.Rooms, func(i, j int) bool {
+		return res.Rooms[i].Created.After(res.Rooms[j].Created)
+	})
+	sort.Slice(res.Posts, func(i, j int) bool {
+		return res.Posts[i].Time.After(res.Posts[j].Time)
+	})
+	if int64(len(res.Rooms)) > n {
+		res.Rooms = res.Rooms[:n]
+	}
+	if int64(len(res.Posts)) > n {
+		res.Posts = res.Posts[:n]
+	}
+	return res, nil
+}
+
+func (db *MemDB) MarkRead(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	serial uint64,
+) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	markers := db.reads[user]
+	if markers == nil {
+		markers = make(map[primitive.ObjectID]uint64)
+		db.reads[user] = markers
+	}
+	if last, ok := markers[roomID]; !ok || serial > last {
+		markers[roomID] = serial
+	}
+	return nil
+}
+
+func (db *MemDB) GetReadMarkers(
+	ctx context.Context,
+	user string,
+	roomIDs []primitive.ObjectID,
+) (map[primitive.ObjectID]uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	markers := make(map[primitive.ObjectID]uint64, len(roomIDs))
+	for _, id := range roomIDs {
+		if serial, ok := db.reads[user][id]; ok {
+			markers[id] = serial
+		}
+	}
+	return markers, nil
+}
+
+func (db *MemDB) SetWatching(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	watch bool,
+) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	watched := db.watches[user]
+	if watched == nil {
+		watched = make(map[primitive.ObjectID]bool)
+		db.watches[user] = watched
+	}
+	if watch {
+		watched[roomID] = true
+	} else {
+		delete(watched, roomID)
+	}
+	return nil
+}
+
+func (db *MemDB) GetWatchedRooms(ctx context.Context, user string) ([]*Room, error) {
+	db.mu.RLock()
+	var rooms []*Room
+	for id := range db.watches[user] {
+		if stored := db.rooms[id]; stored != nil {
+			room := *stored
+			rooms = append(rooms, &room)
+		}
+	}
+	db.mu.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Updated.After(rooms[j].Updated)
+	})
+	return rooms, nil
+}
+
+func (db *MemDB) IsWatching(ctx context.Context, user string, roomID primitive.ObjectID) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.watches[user][roomID], nil
+}
+
+func (db *MemDB) CreateUser(ctx context.Context, user *User) error {
+	if err := user.hashPassword(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.users[user.Name] != nil {
+		return ErrDuplicate
+	}
+	user.ID = primitive.NewObjectID()
+	stored := *user
+	stored.Password = ""
+	db.users[user.Name] = &stored
+	user.clearSensitive()
+	return nil
+}
+
+func (db *MemDB) Authenticate(ctx context.Context, user *User) error {
+	db.mu.RLock()
+	stored := db.users[user.Name]
+	db.mu.RUnlock()
+	if stored == nil {
+		return ErrBadCredentials
+	}
+	password := user.Password
+	*user = *stored
+	user.Password = password
+	if err := user.checkPassword(); err != nil {
+		return err
+	}
+	user.clearSensitive()
+	return nil
+}
+
+func (db *MemDB) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user := db.users[name]
+	if user == nil {
+		return nil, ErrNotFound
+	}
+	profile := &Profile{Name: user.Name, Joined: user.ID.Timestamp()}
+	for _, room := range db.rooms {
+		if room.Author == name {
+			profile.Rooms++
+		}
+	}
+	for _, stored := range db.posts {
+		for _, post := range stored {
+			if post.Author == name && post.Deleted.IsZero() {
+				profile.Posts++
+			}
+		}
+	}
+	return profile, nil
+}
+
+func (db *MemDB) GetPostsByAuthor(
+	ctx context.Context,
+	author string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	return db.findNewestPosts(cursor, n, func(p *Post) bool {
+		return p.Author == author
+	})
+}
+
+func (db *MemDB) GetPostsMentioning(
+	ctx context.Context,
+	user string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	return db.findNewestPosts(cursor, n, func(p *Post) bool {
+		if p.Author == user {
+			return false
+		}
+		for _, name := range p.Mentions {
+			if name == user {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// findNewestPosts returns up to n undeleted posts that match,
+// newest first, starting after cursor (see PostCursor) if it's not empty.
+func (db *MemDB) findNewestPosts(cursor string, n int64, match func(*Post) bool) ([]*Post, error) {
+	var after *Post
+	if cursor != "" {
+		var err error
+		if after, err = parsePostCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	newer := func(a, b *Post) bool {
+		if a.Time.Equal(b.Time) {
+			return bytes.Compare(a.ID[:], b.ID[:]) > 0
+		}
+		return a.Time.After(b.Time)
+	}
+	// There's no index, so just scan them all. Good enough for testing.
+	db.mu.RLock()
+	var posts []*Post
+	for _, stored := range db.posts {
+		for _, p := range stored {
+			if !match(p) || !p.Deleted.IsZero() ||
+				after != nil && !newer(after, p) {
+				continue
+			}
+			post := *p
+			post.Revisions = nil
+			posts = append(posts, &post)
+		}
+	}
+	db.mu.RUnlock()
+	sort.Slice(posts, func(i, j int) bool {
+		return newer(posts[i], posts[j])
+	})
+	if int64(len(posts)) > n {
+		posts = posts[:n]
+	}
+	return posts, nil
+}
+
+func (db *MemDB) GetUser(ctx context.Context, name string) (*User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := db.users[name]
+	if stored == nil {
+		return nil, ErrNotFound
+	}
+	user := *stored
+	user.clearSensitive()
+	if user.Ban.inForce(time.Now()) {
+		ban := *user.Ban
+		user.Ban = &ban
+	} else {
+		user.Ban = nil
+	}
+	return &user, nil
+}
+
+func (db *MemDB) SetRole(ctx context.Context, name string, role Role) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.users[name]
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.Role = role
+	return nil
+}
+
+func (db *MemDB) SetBan(ctx context.Context, name string, ban *Ban) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stored := db.users[name]
+	if stored == nil {
+		return ErrNotFound
+	}
+	stored.Ban = nil
+	if ban != nil {
+		copied := *ban
+		stored.Ban = &copied
+	}
+	return nil
+}
+
+func (db *MemDB) LogModAction(ctx context.Context, action *ModAction) error {
+	action.ID = primitive.NewObjectID()
+	action.Time = time.Now()
+	stored := *action
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.modlog = append(db.modlog, &stored)
+	return nil
+}
+
+func (db *MemDB) GetModLog(ctx context.Context, n int64) ([]*ModAction, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var actions []*ModAction
+	for i := len(db.modlog) - 1; i >= 0 && int64(len(actions)) < n; i-- {
+		action := *db.modlog[i]
+		actions = append(actions, &action)
+	}
+	return actions, nil
+}
+
+func (db *MemDB) insertFakePost(ctx context.Context, post *Post) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	post.ID = primitive.NewObjectID()
+	stored := *post
+	db.posts[post.RoomID] = append(db.posts[post.RoomID], &stored)
+	return nil
+}
+
+func (db *MemDB) replaceFakeRoom(ctx context.Context, room *Room) error {
+	stored := *room
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.rooms[room.ID] = &stored
+	return nil
+}
@@ -0,0 +1,23 @@
+package store
+
+import "testing"
+
+func newTestMemDB(t *testing.T) *MemDB {
+	t.Helper()
+	db, err := NewMemDB(NewLocalBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.CancelStreams)
+	return db
+}
+
+func TestMemCreatePost(t *testing.T)     { testCreatePost(t, newTestMemDB(t)) }
+func TestMemRoomStates(t *testing.T)     { testRoomStates(t, newTestMemDB(t)) }
+func TestMemGetPosts(t *testing.T)       { testGetPosts(t, newTestMemDB(t)) }
+func TestMemEditDeletePost(t *testing.T) { testEditDeletePost(t, newTestMemDB(t)) }
+func TestMemToggleReaction(t *testing.T) { testToggleReaction(t, newTestMemDB(t)) }
+func TestMemStreamRoom(t *testing.T)     { testStreamRoom(t, newTestMemDB(t)) }
+func TestMemAuthenticate(t *testing.T)   { testAuthenticate(t, newTestMemDB(t)) }
+func TestMemGetRoomsByID(t *testing.T)   { testGetRoomsByID(t, newTestMemDB(t)) }
+func TestMemWatching(t *testing.T)       { testWatching(t, newTestMemDB(t)) }
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mentionName matches a name that can be mentioned: letters, digits
+// and _ . - but not ending with . or - (which are more likely punctuation).
+// Users whose names don't match can't be mentioned.
+var mentionName = regexp.MustCompile(`^[\pL\pN_](?:[\pL\pN_.-]*[\pL\pN_])?`)
+
+// MentionAt returns the name mentioned by the @ at the start of s, or "".
+// before is the rune preceding the @, or utf8.RuneError at the start of text:
+// an @ right after a letter or digit, as in an email address, is no mention.
+func MentionAt(s string, before rune) string {
+	if !strings.HasPrefix(s, "@") {
+		return ""
+	}
+	if before != utf8.RuneError &&
+		(unicode.IsLetter(before) || unicode.IsDigit(before) || strings.ContainsRune("_.-@", before)) {
+		return ""
+	}
+	return mentionName.FindString(s[1:])
+}
+
+// ParseMentions returns the names mentioned in text as @name,
+// without duplicates, in order of first mention.
+func ParseMentions(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for i := strings.IndexByte(text, '@'); i >= 0; {
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		if name := MentionAt(text[i:], before); name != "" && !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+		j := strings.IndexByte(text[i+1:], '@')
+		if j < 0 {
+			break
+		}
+		i += 1 + j
+	}
+	return names
+}
+
+// onlyExisting returns those of names that are in exists, in the same order,
+// or nil if there are none.
+func onlyExisting(names []string, exists func(name string) bool) []string {
+	var existing []string
+	for _, name := range names {
+		if exists(name) {
+			existing = append(existing, name)
+		}
+	}
+	return existing
+}
+
+// parseMentions sets post.Mentions to the existing users mentioned in its text.
+func (db *DB) parseMentions(ctx context.Context, post *Post) error {
+	post.Mentions = nil
+	names := ParseMentions(post.Text)
+	if len(names) == 0 {
+		return nil
+	}
+	cur, err := db.users.Find(ctx, bson.M{"name": bson.M{"$in": names}},
+		options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return err
+	}
+	var users []struct{ Name string }
+	if err := cur.All(ctx, &users); err != nil {
+		return err
+	}
+	found := make(map[string]bool, len(users))
+	for _, user := range users {
+		found[user.Name] = true
+	}
+	post.Mentions = onlyExisting(names, func(name string) bool { return found[name] })
+	return nil
+}
+
+// GetPostsMentioning returns up to n posts that mention user, newest first,
+// starting after cursor (see PostCursor) if it's not empty. Posts by user
+// and deleted posts are not included.
+func (db *DB) GetPostsMentioning(
+	ctx context.Context,
+	user string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	filter := bson.M{
+		"mentions": user,
+		"author":   bson.M{"$ne": user},
+		"deleted":  bson.M{"$exists": false},
+	}
+	if cursor != "" {
+		after, err := parsePostCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter["$or"] = bson.A{
+			bson.M{"time": bson.M{"$lt": after.Time}},
+			bson.M{"time": after.Time, "_id": bson.M{"$lt": after.ID}},
+		}
+	}
+	cur, err := db.posts.Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(n).
+			SetProjection(withoutRevisions))
+	if err != nil {
+		return nil, err
+	}
+	var posts []*Post
+	err = cur.All(ctx, &posts)
+	return posts, err
+}
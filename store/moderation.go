@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Role determines what a user may do besides posting.
+type Role string
+
+const (
+	RoleUser      Role = ""
+	RoleModerator Role = "moderator" // may delete and edit posts, lock rooms, ban users
+	RoleAdmin     Role = "admin"     // may also set roles
+)
+
+var roles = []Role{RoleUser, RoleModerator, RoleAdmin}
+
+func (role Role) String() string {
+	if role == RoleUser {
+		return "user"
+	}
+	return string(role)
+}
+
+// ParseRole returns the Role whose String is s.
+func ParseRole(s string) (Role, error) {
+	for _, role := range roles {
+		if s == role.String() {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("unknown role: %q", s)
+}
+
+// CanModerate reports whether role permits moderator actions.
+func (role Role) CanModerate() bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// Ban keeps a user from posting, creating rooms, and changing anything.
+type Ban struct {
+	Time   time.Time
+	Until  time.Time `bson:",omitempty"` // zero if the ban is permanent
+	By     string    // moderator who banned the user
+	Reason string
+}
+
+// inForce reports whether ban applies at now.
+func (ban *Ban) inForce(now time.Time) bool {
+	return ban != nil && (ban.Until.IsZero() || now.Before(ban.Until))
+}
+
+// ModAction is an entry in the moderation log.
+type ModAction struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Time      time.Time
+	Moderator string
+	Action    string
+	// What the action applied to: a user, a room, or a post in a room.
+	User   string             `bson:",omitempty"`
+	RoomID primitive.ObjectID `bson:"roomId,omitempty"`
+	Serial uint64             `bson:",omitempty"`
+	Note   string             `bson:",omitempty"` // reason, new role, etc.
+}
+
+// Values for ModAction.Action.
+const (
+	ModDeletePost  = "delete post"
+	ModEditPost    = "edit post"
+	ModEditRoom    = "edit room"
+	ModLockRoom    = "lock room"
+	ModArchiveRoom = "archive room"
+	ModReopenRoom  = "reopen room"
+	ModBan         = "ban user"
+	ModUnban       = "unban user"
+	ModSetRole     = "set role"
+)
+
+// GetUser returns the user with name, without credentials, or ErrNotFound.
+// An expired Ban is not returned.
+func (db *DB) GetUser(ctx context.Context, name string) (*User, error) {
+	user := &User{}
+	err := db.users.FindOne(ctx, bson.M{"name": name}).Decode(user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.clearSensitive()
+	if !user.Ban.inForce(time.Now()) {
+		user.Ban = nil
+	}
+	return user, nil
+}
+
+// SetRole changes the role of the user with name, or returns ErrNotFound.
+func (db *DB) SetRole(ctx context.Context, name string, role Role) error {
+	var update bson.M
+	if role == RoleUser {
+		update = bson.M{"$unset": bson.M{"role": ""}}
+	} else {
+		update = bson.M{"$set": bson.M{"role": role}}
+	}
+	return db.updateUser(ctx, name, update)
+}
+
+// SetBan bans the user with name, replacing any previous ban,
+// or lifts the ban if ban is nil. It returns ErrNotFound if there is
+// no such user.
+func (db *DB) SetBan(ctx context.Context, name string, ban *Ban) error {
+	var update bson.M
+	if ban == nil {
+		update = bson.M{"$unset": bson.M{"ban": ""}}
+	} else {
+		update = bson.M{"$set": bson.M{"ban": ban}}
+	}
+	return db.updateUser(ctx, name, update)
+}
+
+func (db *DB) updateUser(ctx context.Context, name string, update bson.M) error {
+	res, err := db.users.UpdateOne(ctx, bson.M{"name": name}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// LogModAction adds action to the moderation log, setting its ID and Time.
+func (db *DB) LogModAction(ctx context.Context, action *ModAction) error {
+	action.ID = primitive.NilObjectID
+	action.Time = time.Now()
+	res, err := db.modlog.InsertOne(ctx, action)
+	if err != nil {
+		return err
+	}
+	action.ID = res.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetModLog returns the n most recent entries of the moderation log,
+// newest first.
+func (db *DB) GetModLog(ctx context.Context, n int64) ([]*ModAction, error) {
+	cur, err := db.modlog.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.M{"time": -1}).SetLimit(n))
+	if err != nil {
+		return nil, err
+	}
+	var actions []*ModAction
+	err = cur.All(ctx, &actions)
+	return actions, err
+}
@@ -18,15 +18,64 @@ type Post struct {
 	Author string
 	Time   time.Time
 	Text   string
+	// ReplyTo is the serial of an earlier post in the same room
+	// that this post replies to, or 0.
+	ReplyTo uint64 `bson:",omitempty"`
+	// Edited and Editor are set by the last EditPost, if any.
+	Edited time.Time `bson:",omitempty"`
+	Editor string    `bson:",omitempty"`
+	// Revisions are the previous versions of the post, oldest first.
+	// They are only filled in by GetPost.
+	Revisions []Revision `bson:",omitempty"`
+	// Deleted and Deleter are set by DeletePost, which turns the post into
+	// a tombstone: it keeps its place (serial) in the room, but loses
+	// its text and revisions.
+	Deleted time.Time `bson:",omitempty"`
+	Deleter string    `bson:",omitempty"`
+	// Mentions are the users mentioned in Text as @name (see ParseMentions)
+	// who existed when the post was created. CreatePost sets them,
+	// and they are not updated by EditPost.
+	Mentions []string `bson:",omitempty"`
+	// Reactions are set by ToggleReaction, oldest first.
+	Reactions []Reaction `bson:",omitempty"`
+	// Attachments are files attached to the post when it was created.
+	// Their contents are kept in a BlobStore.
+	Attachments []Attachment `bson:",omitempty"`
 }
 
+// Revision is a version of a post that has been replaced by EditPost.
+type Revision struct {
+	Text   string
+	Time   time.Time
+	Editor string
+}
+
+// current returns the current version of post as a Revision.
+func (post *Post) current() Revision {
+	if post.Edited.IsZero() {
+		return Revision{Text: post.Text, Time: post.Time, Editor: post.Author}
+	}
+	return Revision{Text: post.Text, Time: post.Edited, Editor: post.Editor}
+}
+
+// withoutRevisions is a projection for queries that return many posts.
+var withoutRevisions = bson.M{"revisions": 0}
+
 func (db *DB) CreatePost(ctx context.Context, post *Post) error {
-	// Update the room to ensure that it exists, bump its update timestamp,
-	// and acquire the serial number for this post. Two posts will never get
+	if err := db.parseMentions(ctx, post); err != nil {
+		return err
+	}
+
+	// Update the room to ensure that it exists and is open (and has
+	// the post replied to), bump its update timestamp, and acquire
+	// the serial number for this post. Two posts will never get
 	// the same serial number because $inc on one master is atomic.
 	post.Time = time.Now()
-	res := db.rooms.FindOneAndUpdate(ctx,
-		bson.M{"_id": post.RoomID},
+	filter := bson.M{"_id": post.RoomID, "state": bson.M{"$exists": false}}
+	if post.ReplyTo > 0 {
+		filter["serial"] = bson.M{"$gte": post.ReplyTo}
+	}
+	res := db.rooms.FindOneAndUpdate(ctx, filter,
 		bson.M{
 			"$set": bson.M{"updated": post.Time},
 			"$inc": bson.M{"serial": 1},
@@ -39,7 +88,19 @@ func (db *DB) CreatePost(ctx context.Context, post *Post) error {
 	err := res.Decode(&room)
 	switch {
 	case errors.Is(err, mongo.ErrNoDocuments):
-		return ErrNotFound
+		// Either there's no such room, or it's not open,
+		// or it has no post to reply to.
+		closed, err := db.GetRoom(ctx, post.RoomID)
+		if err != nil {
+			return err
+		}
+		if closed == nil {
+			return ErrNotFound
+		}
+		if closed.State == RoomOpen {
+			return ErrBadReply
+		}
+		return &RoomClosedError{closed.State}
 	case err != nil:
 		return err
 	}
@@ -60,13 +121,91 @@ func (db *DB) insertPost(ctx context.Context, post *Post) error {
 	return nil
 }
 
+// GetPost returns the post with the given serial number in room,
+// or ErrNotFound.
+func (db *DB) GetPost(ctx context.Context, room *Room, serial uint64) (*Post, error) {
+	post := &Post{}
+	err := db.posts.FindOne(ctx, bson.M{"roomId": room.ID, "serial": serial}).
+		Decode(post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	return post, err
+}
+
+// EditPost replaces the text of post with text written by editor, saving
+// the previous version to post.Revisions. The post is identified by its ID,
+// and all its fields are updated from the database. A deleted post cannot be
+// edited: EditPost returns ErrNotFound for it.
+func (db *DB) EditPost(ctx context.Context, post *Post, editor, text string) error {
+	// Use an update pipeline, so that the previous version is taken
+	// from the document itself, atomically. Strings from the user are wrapped
+	// in $literal, lest they be interpreted as field paths or operators.
+	res := db.posts.FindOneAndUpdate(ctx,
+		bson.M{"_id": post.ID, "deleted": bson.M{"$exists": false}},
+		bson.A{bson.M{"$set": bson.M{
+			"revisions": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+				bson.A{bson.M{
+					"text":   "$text",
+					"time":   bson.M{"$ifNull": bson.A{"$edited", "$time"}},
+					"editor": bson.M{"$ifNull": bson.A{"$editor", "$author"}},
+				}},
+			}},
+			"text":   bson.M{"$literal": text},
+			"edited": time.Now(),
+			"editor": bson.M{"$literal": editor},
+		}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+	*post = Post{}
+	err := res.Decode(post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DeletePost turns post into a tombstone deleted by deleter, dropping its
+// reactions and attachments. The post is identified by its ID, and all its fields are
+// updated from the database.
+// Deleting a post that is already deleted is not an error, but doesn't
+// change who deleted it or when.
+func (db *DB) DeletePost(ctx context.Context, post *Post, deleter string) error {
+	res := db.posts.FindOneAndUpdate(ctx,
+		bson.M{"_id": post.ID, "deleted": bson.M{"$exists": false}},
+		bson.M{
+			"$set": bson.M{
+				"text":    "",
+				"deleted": time.Now(),
+				"deleter": deleter,
+			},
+			"$unset": bson.M{"revisions": "", "reactions": "", "attachments": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+	id := post.ID
+	*post = Post{}
+	err := res.Decode(post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Either there is no such post, or it's already deleted.
+		err = db.posts.FindOne(ctx, bson.M{"_id": id}).Decode(post)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
 func (db *DB) GetPostsSince(
 	ctx context.Context,
 	room *Room,
 	since uint64,
 	n int64,
 ) ([]*Post, error) { // TODO: []Post?
-	opts := options.Find().SetSort(bson.M{"serial": 1})
+	opts := options.Find().
+		SetSort(bson.M{"serial": 1}).
+		SetProjection(withoutRevisions)
 	if n > 0 {
 		opts = opts.SetLimit(n)
 	}
@@ -81,7 +220,11 @@ func (db *DB) GetPostsSince(
 		return nil, err
 	}
 	defer cur.Close(ctx)
-	posts := make([]*Post, 0, n)
+	// n <= 0 means no limit, so it's no use as capacity.
+	posts := []*Post{}
+	if n > 0 {
+		posts = make([]*Post, 0, n)
+	}
 	for cur.Next(ctx) {
 		post := &Post{}
 		err = cur.Decode(post)
@@ -100,6 +243,10 @@ func (db *DB) GetPostsBefore(
 	before uint64,
 	n int64,
 ) ([]*Post, error) { // TODO: []Post?
+	if n <= 0 {
+		// SetLimit(0) would mean no limit.
+		return nil, nil
+	}
 	cur, err := db.posts.Find(ctx,
 		bson.M{
 			"roomId": room.ID,
@@ -107,7 +254,8 @@ func (db *DB) GetPostsBefore(
 		},
 		options.Find().
 			SetSort(bson.M{"serial": -1}).
-			SetLimit(n),
+			SetLimit(n).
+			SetProjection(withoutRevisions),
 	)
 	if err != nil {
 		return nil, err
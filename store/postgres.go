@@ -0,0 +1,1256 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PgDB is a Store backed by PostgreSQL. IDs are still MongoDB-style ObjectIDs,
+// stored as hex strings. New posts are streamed to all processes connected
+// to the same database by means of LISTEN/NOTIFY.
+type PgDB struct {
+	sqldb     *sql.DB
+	publisher Publisher    // nil if not watching for new posts
+	listener  *pq.Listener // nil if not watching for new posts
+	*pump
+}
+
+// pgChannel is the name of the PostgreSQL notification channel on which
+// changes to posts are announced. The payload of each notification is
+// the EventType number and the post ID, separated by a space.
+const pgChannel = "nnbb_posts"
+
+// pgSchema is executed by InitDB. The unique constraint on posts mirrors
+// the MongoDB index on roomId+serial.
+const pgSchema = `
+CREATE TABLE users (
+	id            text PRIMARY KEY,
+	name          text NOT NULL UNIQUE,
+	password_hash text NOT NULL,
+	role          text NOT NULL DEFAULT '',
+	banned        timestamptz, -- NULL if not banned
+	ban_until     timestamptz, -- NULL if banned permanently
+	ban_by        text NOT NULL DEFAULT '',
+	ban_reason    text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE rooms (
+	id          text PRIMARY KEY,
+	title       text NOT NULL,
+	description text NOT NULL DEFAULT '',
+	author      text NOT NULL,
+	created     timestamptz NOT NULL,
+	updated     timestamptz NOT NULL,
+	serial      bigint NOT NULL,
+	state       text NOT NULL DEFAULT ''
+);
+CREATE INDEX rooms_updated ON rooms (updated, id);
+CREATE INDEX rooms_created ON rooms (created, id);
+CREATE INDEX rooms_serial ON rooms (serial, id);
+CREATE INDEX rooms_title ON rooms ((title COLLATE "C"), id);
+CREATE INDEX rooms_search ON rooms USING GIN (to_tsvector('english', title));
+CREATE INDEX rooms_author ON rooms (author);
+
+CREATE TABLE posts (
+	id      text PRIMARY KEY,
+	room_id text NOT NULL REFERENCES rooms (id),
+	serial  bigint NOT NULL,
+	author  text NOT NULL,
+	time    timestamptz NOT NULL,
+	text    text NOT NULL,
+	edited  timestamptz,
+	editor  text NOT NULL DEFAULT '',
+	deleted timestamptz,
+	deleter text NOT NULL DEFAULT '',
+	mentions text[] NOT NULL DEFAULT '{}',
+	reply_to bigint NOT NULL DEFAULT 0,
+	attachments jsonb,
+	UNIQUE (room_id, serial)
+);
+
+CREATE INDEX posts_search ON posts USING GIN (to_tsvector('english', text));
+CREATE INDEX posts_author ON posts (author, time, id);
+CREATE INDEX posts_mentions ON posts USING GIN (mentions);
+CREATE INDEX posts_attachments ON posts USING GIN (attachments jsonb_path_ops);
+
+CREATE TABLE reads (
+	user_name text NOT NULL,
+	room_id   text NOT NULL REFERENCES rooms (id),
+	serial    bigint NOT NULL,
+	PRIMARY KEY (user_name, room_id)
+);
+
+CREATE TABLE watches (
+	user_name text NOT NULL,
+	room_id   text NOT NULL REFERENCES rooms (id),
+	PRIMARY KEY (user_name, room_id)
+);
+
+CREATE TABLE revisions (
+	post_id text NOT NULL REFERENCES posts (id),
+	n       integer NOT NULL,
+	text    text NOT NULL,
+	time    timestamptz NOT NULL,
+	editor  text NOT NULL,
+	PRIMARY KEY (post_id, n)
+);
+
+CREATE TABLE reactions (
+	post_id   text NOT NULL REFERENCES posts (id),
+	user_name text NOT NULL,
+	emoji     text NOT NULL,
+	time      timestamptz NOT NULL,
+	PRIMARY KEY (post_id, user_name, emoji)
+);
+
+CREATE TABLE modlog (
+	id        text PRIMARY KEY,
+	time      timestamptz NOT NULL,
+	moderator text NOT NULL,
+	action    text NOT NULL,
+	user_name text NOT NULL,
+	room_id   text NOT NULL, -- not a reference: may be '' or a deleted room
+	serial    bigint NOT NULL,
+	note      text NOT NULL
+);
+CREATE INDEX modlog_time ON modlog (time);
+`
+
+func connectPostgres(ctx context.Context, uri *url.URL, broker Broker) (*PgDB, error) {
+	log.Printf("store: connecting to %v", uri.Redacted())
+	sqldb, err := sql.Open("postgres", uri.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := sqldb.PingContext(ctx); err != nil {
+		sqldb.Close()
+		return nil, err
+	}
+	db := &PgDB{sqldb: sqldb}
+
+	if pub, ok := broker.(Publisher); ok {
+		db.publisher = pub
+		db.listener = pq.NewListener(uri.String(), time.Second, time.Minute,
+			func(ev pq.ListenerEventType, err error) {
+				if err != nil {
+					log.Printf("store: notification listener: %v", err)
+				}
+			})
+		if err := db.listener.Listen(pgChannel); err != nil {
+			db.listener.Close()
+			sqldb.Close()
+			return nil, err
+		}
+	}
+	// Nothing can fail from here on, so the pump's goroutine isn't leaked.
+	if broker != nil {
+		db.pump = newPump(broker)
+	}
+	if db.listener != nil {
+		go db.runListener()
+	}
+
+	return db, nil
+}
+
+func initPostgres(ctx context.Context, db *PgDB) error {
+	log.Print("store: creating tables and indexes")
+	_, err := db.sqldb.ExecContext(ctx, pgSchema)
+	return err
+}
+
+func (db *PgDB) Disconnect(ctx context.Context) {
+	log.Print("store: disconnecting from PostgreSQL")
+	if db.listener != nil {
+		if err := db.listener.Close(); err != nil {
+			log.Printf("store: failed to close listener: %v", err)
+		}
+	}
+	if err := db.sqldb.Close(); err != nil {
+		log.Printf("store: failed to disconnect: %v", err)
+	}
+}
+
+// notify announces an event to all listening processes, once tx commits.
+// id is the ID of the room (for RoomUpdated) or post (for others).
+func (db *PgDB) notify(ctx context.Context, tx *sql.Tx, typ EventType, id primitive.ObjectID) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`,
+		pgChannel, fmt.Sprintf("%d %s", typ, id.Hex()))
+	return err
+}
+
+// runListener publishes events announced via NOTIFY.
+func (db *PgDB) runListener() {
+	ctx := context.Background()
+	for n := range db.listener.Notify {
+		if n == nil {
+			// The listener has reconnected to the database. Any posts
+			// created in the meantime have not been announced to us,
+			// so listeners need to refetch them.
+			log.Print("store: notification listener reconnected")
+			db.publisher.Publish(Event{Type: Resync})
+			continue
+		}
+		var typ EventType
+		var idHex string
+		_, err := fmt.Sscanf(n.Extra, "%d %s", &typ, &idHex)
+		if err != nil {
+			log.Printf("store: bad notification payload %q: %v", n.Extra, err)
+			continue
+		}
+		id, err := primitive.ObjectIDFromHex(idHex)
+		if err != nil {
+			log.Printf("store: bad notification payload %q: %v", n.Extra, err)
+			continue
+		}
+		if typ == RoomUpdated {
+			room, err := db.GetRoom(ctx, id)
+			if err != nil || room == nil {
+				log.Printf("store: failed to get notified room %v: %v", idHex, err)
+				continue
+			}
+			db.publisher.Publish(Event{Type: typ, Room: room})
+			continue
+		}
+		post, err := db.getPost(ctx, id)
+		if err != nil {
+			log.Printf("store: failed to get notified post %v: %v", idHex, err)
+			continue
+		}
+		db.publisher.Publish(Event{Type: typ, Post: post})
+	}
+}
+
+func (db *PgDB) CreateRoom(ctx context.Context, room *Room) error {
+	room.ID = primitive.NewObjectID()
+	room.Created = time.Now()
+	room.Updated = room.Created
+	room.Serial = 0
+	_, err := db.sqldb.ExecContext(ctx,
+		`INSERT INTO rooms (id, title, description, author, created, updated, serial)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		room.ID.Hex(), room.Title, room.Description, room.Author,
+		room.Created, room.Updated, room.Serial)
+	return err
+}
+
+const pgRoomColumns = `id, title, description, author, created, updated, serial, state`
+
+func scanRoom(row interface{ Scan(...interface{}) error }) (*Room, error) {
+	room := &Room{}
+	var id string
+	err := row.Scan(&id, &room.Title, &room.Description, &room.Author,
+		&room.Created, &room.Updated, &room.Serial, &room.State)
+	if err != nil {
+		return nil, err
+	}
+	room.Created = room.Created.UTC()
+	room.Updated = room.Updated.UTC()
+	room.ID, err = primitive.ObjectIDFromHex(id)
+	return room, err
+}
+
+func (db *PgDB) GetRoom(ctx context.Context, id primitive.ObjectID) (*Room, error) {
+	row := db.sqldb.QueryRowContext(ctx,
+		`SELECT `+pgRoomColumns+` FROM rooms WHERE id = $1`, id.Hex())
+	room, err := scanRoom(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return room, err
+}
+
+func (db *PgDB) GetRoomsByID(
+	ctx context.Context,
+	ids []primitive.ObjectID,
+) (map[primitive.ObjectID]*Room, error) {
+	hexes := make([]string, len(ids))
+	for i, id := range ids {
+		hexes[i] = id.Hex()
+	}
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT `+pgRoomColumns+` FROM rooms WHERE id = ANY($1)`,
+		pq.Array(hexes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := make(map[primitive.ObjectID]*Room, len(ids))
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms[room.ID] = room
+	}
+	return rooms, rows.Err()
+}
+
+func (db *PgDB) GetRooms(
+	ctx context.Context,
+	order RoomOrder,
+	cursor string,
+	n int64,
+) ([]*Room, error) {
+	field := roomOrders[order].field
+	if order == ByTitle {
+		// Compare by code point, like the other backends do.
+		field = `title COLLATE "C"`
+	}
+	dir, cmp := "ASC", ">"
+	if roomOrders[order].desc {
+		dir, cmp = "DESC", "<"
+	}
+	query := `SELECT ` + pgRoomColumns + ` FROM rooms`
+	args := []interface{}{n}
+	if cursor != "" {
+		after, err := order.parseCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query += ` WHERE (` + field + `, id) ` + cmp + ` ($2, $3)`
+		args = append(args, order.key(after), after.ID.Hex())
+	}
+	query += ` ORDER BY ` + field + ` ` + dir + `, id ` + dir + ` LIMIT $1`
+	rows, err := db.sqldb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []*Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (db *PgDB) UpdateRoom(ctx context.Context, room *Room) error {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	row := tx.QueryRowContext(ctx,
+		`UPDATE rooms SET title = $2, description = $3, updated = $4
+		WHERE id = $1 RETURNING `+pgRoomColumns,
+		room.ID.Hex(), room.Title, room.Description, time.Now())
+	updated, err := scanRoom(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.notify(ctx, tx, RoomUpdated, room.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*room = *updated
+	return nil
+}
+
+func (db *PgDB) SetRoomState(ctx context.Context, room *Room, state RoomState) error {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	row := tx.QueryRowContext(ctx,
+		`UPDATE rooms SET state = $2 WHERE id = $1 RETURNING `+pgRoomColumns,
+		room.ID.Hex(), state)
+	updated, err := scanRoom(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.notify(ctx, tx, RoomUpdated, room.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*room = *updated
+	return nil
+}
+
+func (db *PgDB) CreatePost(ctx context.Context, post *Post) error {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Unlike with MongoDB, bumping the room's serial and inserting the post
+	// happen in one transaction, so they can't get out of sync.
+	// The row lock taken by UPDATE serializes concurrent posts to a room.
+	post.ID = primitive.NewObjectID()
+	post.Time = time.Now()
+	err = tx.QueryRowContext(ctx,
+		`UPDATE rooms SET serial = serial + 1, updated = $2
+		WHERE id = $1 AND state = '' AND serial >= $3 RETURNING serial`,
+		post.RoomID.Hex(), post.Time, post.ReplyTo,
+	).Scan(&post.Serial)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Either there's no such room, or it's not open,
+		// or it has no post to reply to.
+		var state RoomState
+		err = tx.QueryRowContext(ctx,
+			`SELECT state FROM rooms WHERE id = $1`, post.RoomID.Hex(),
+		).Scan(&state)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if state == RoomOpen {
+			return ErrBadReply
+		}
+		return &RoomClosedError{state}
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.parseMentions(ctx, tx, post); err != nil {
+		return err
+	}
+	var attachments []byte // JSON, or NULL if none
+	if len(post.Attachments) > 0 {
+		if attachments, err = json.Marshal(post.Attachments); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO posts (id, room_id, serial, author, time, text, mentions, reply_to, attachments)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		post.ID.Hex(), post.RoomID.Hex(), post.Serial,
+		post.Author, post.Time, post.Text, pq.Array(post.Mentions), post.ReplyTo,
+		attachments)
+	if err != nil {
+		return err
+	}
+	if err := db.notify(ctx, tx, PostCreated, post.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// parseMentions sets post.Mentions to the existing users mentioned in its text.
+func (db *PgDB) parseMentions(ctx context.Context, tx *sql.Tx, post *Post) error {
+	post.Mentions = nil
+	names := ParseMentions(post.Text)
+	if len(names) == 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx,
+		`SELECT name FROM users WHERE name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	found := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		found[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	post.Mentions = onlyExisting(names, func(name string) bool { return found[name] })
+	return nil
+}
+
+func (db *PgDB) HasAttachment(ctx context.Context, blob string) (bool, error) {
+	byBlob, err := json.Marshal([]map[string]string{{"Blob": blob}})
+	if err != nil {
+		return false, err
+	}
+	byThumb, err := json.Marshal([]map[string]string{{"Thumb": blob}})
+	if err != nil {
+		return false, err
+	}
+	var found bool
+	err = db.sqldb.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM posts
+			WHERE attachments @> $1::jsonb OR attachments @> $2::jsonb)`,
+		string(byBlob), string(byThumb),
+	).Scan(&found)
+	return found, err
+}
+
+// pgPostColumns are scanned by scanPost. The reactions are aggregated
+// from their own table, so they must be selected FROM posts (not aliased).
+const pgPostColumns = `id, room_id, serial, author, time, text, edited, editor, deleted, deleter, mentions, reply_to, attachments,
+	(SELECT json_agg(json_build_object('User', user_name, 'Emoji', emoji) ORDER BY time)
+		FROM reactions WHERE post_id = posts.id)`
+
+func scanPost(row interface{ Scan(...interface{}) error }) (*Post, error) {
+	post := &Post{}
+	var id, roomID string
+	var edited, deleted sql.NullTime
+	var mentions pq.StringArray
+	var attachments, reactions []byte // JSON, or NULL if none
+	err := row.Scan(&id, &roomID, &post.Serial,
+		&post.Author, &post.Time, &post.Text, &edited, &post.Editor,
+		&deleted, &post.Deleter, &mentions, &post.ReplyTo, &attachments, &reactions)
+	if err != nil {
+		return nil, err
+	}
+	if attachments != nil {
+		if err := json.Unmarshal(attachments, &post.Attachments); err != nil {
+			return nil, err
+		}
+	}
+	if reactions != nil {
+		if err := json.Unmarshal(reactions, &post.Reactions); err != nil {
+			return nil, err
+		}
+	}
+	if len(mentions) > 0 {
+		post.Mentions = mentions
+	}
+	post.Time = post.Time.UTC()
+	if edited.Valid {
+		post.Edited = edited.Time.UTC()
+	}
+	if deleted.Valid {
+		post.Deleted = deleted.Time.UTC()
+	}
+	if post.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	post.RoomID, err = primitive.ObjectIDFromHex(roomID)
+	return post, err
+}
+
+func (db *PgDB) getPost(ctx context.Context, id primitive.ObjectID) (*Post, error) {
+	row := db.sqldb.QueryRowContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE id = $1`, id.Hex())
+	post, err := scanPost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return post, err
+}
+
+func (db *PgDB) GetPost(ctx context.Context, room *Room, serial uint64) (*Post, error) {
+	row := db.sqldb.QueryRowContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE room_id = $1 AND serial = $2`,
+		room.ID.Hex(), serial)
+	post, err := scanPost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	post.Revisions, err = db.getRevisions(ctx, db.sqldb, post)
+	return post, err
+}
+
+// getRevisions returns the revisions of post from q (a *sql.DB or *sql.Tx).
+func (db *PgDB) getRevisions(
+	ctx context.Context,
+	q interface {
+		QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	},
+	post *Post,
+) ([]Revision, error) {
+	rows, err := q.QueryContext(ctx,
+		`SELECT text, time, editor FROM revisions WHERE post_id = $1 ORDER BY n`,
+		post.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revs []Revision
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.Text, &rev.Time, &rev.Editor); err != nil {
+			return revs, err
+		}
+		rev.Time = rev.Time.UTC()
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+func (db *PgDB) EditPost(ctx context.Context, post *Post, editor, text string) error {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Lock the post, so that concurrent edits don't mix up revisions.
+	row := tx.QueryRowContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE id = $1 FOR UPDATE`,
+		post.ID.Hex())
+	current, err := scanPost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !current.Deleted.IsZero() {
+		return ErrNotFound
+	}
+	rev := current.current()
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO revisions (post_id, n, text, time, editor)
+		SELECT $1, count(*), $2, $3, $4 FROM revisions WHERE post_id = $1`,
+		current.ID.Hex(), rev.Text, rev.Time, rev.Editor)
+	if err != nil {
+		return err
+	}
+	current.Text = text
+	current.Edited = time.Now()
+	current.Editor = editor
+	_, err = tx.ExecContext(ctx,
+		`UPDATE posts SET text = $2, edited = $3, editor = $4 WHERE id = $1`,
+		current.ID.Hex(), current.Text, current.Edited, current.Editor)
+	if err != nil {
+		return err
+	}
+	if current.Revisions, err = db.getRevisions(ctx, tx, current); err != nil {
+		return err
+	}
+	if err := db.notify(ctx, tx, PostEdited, current.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*post = *current
+	return nil
+}
+
+func (db *PgDB) DeletePost(ctx context.Context, post *Post, deleter string) error {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	row := tx.QueryRowContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE id = $1 FOR UPDATE`,
+		post.ID.Hex())
+	current, err := scanPost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if current.Deleted.IsZero() {
+		current.Text = ""
+		current.Deleted = time.Now()
+		current.Deleter = deleter
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM revisions WHERE post_id = $1`, current.ID.Hex())
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			`DELETE FROM reactions WHERE post_id = $1`, current.ID.Hex())
+		if err != nil {
+			return err
+		}
+		current.Reactions = nil
+		current.Attachments = nil
+		_, err = tx.ExecContext(ctx,
+			`UPDATE posts SET text = '', deleted = $2, deleter = $3, attachments = NULL
+			WHERE id = $1`,
+			current.ID.Hex(), current.Deleted, current.Deleter)
+		if err != nil {
+			return err
+		}
+		if err := db.notify(ctx, tx, PostDeleted, current.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*post = *current
+	return nil
+}
+
+func (db *PgDB) ToggleReaction(ctx context.Context, post *Post, user, emoji string) (bool, error) {
+	tx, err := db.sqldb.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Lock the post, so that it isn't deleted meanwhile.
+	var deleted sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		`SELECT deleted FROM posts WHERE id = $1 FOR UPDATE`, post.ID.Hex(),
+	).Scan(&deleted)
+	if errors.Is(err, sql.ErrNoRows) || deleted.Valid {
+		return false, ErrNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.ExecContext(ctx,
+		`DELETE FROM reactions WHERE post_id = $1 AND user_name = $2 AND emoji = $3`,
+		post.ID.Hex(), user, emoji)
+	if err != nil {
+		return false, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if removed == 0 {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO reactions (post_id, user_name, emoji, time)
+			VALUES ($1, $2, $3, $4)`,
+			post.ID.Hex(), user, emoji, time.Now())
+		if err != nil {
+			return false, err
+		}
+	}
+	row := tx.QueryRowContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE id = $1`, post.ID.Hex())
+	current, err := scanPost(row)
+	if err != nil {
+		return false, err
+	}
+	if err := db.notify(ctx, tx, PostReacted, current.ID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	*post = *current
+	return removed == 0, nil
+}
+
+func (db *PgDB) GetPostsSince(
+	ctx context.Context,
+	room *Room,
+	since uint64,
+	n int64,
+) ([]*Post, error) {
+	limit := sql.NullInt64{Int64: n, Valid: n > 0}
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts
+		WHERE room_id = $1 AND serial > $2
+		ORDER BY serial LIMIT $3`,
+		room.ID.Hex(), since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// n <= 0 means no limit, so it's no use as capacity.
+	posts := []*Post{}
+	if n > 0 {
+		posts = make([]*Post, 0, n)
+	}
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return posts, err
+		}
+		posts = append(posts, post)
+		room.fixup(post)
+	}
+	return posts, rows.Err()
+}
+
+func (db *PgDB) GetPostsBefore(
+	ctx context.Context,
+	room *Room,
+	before uint64,
+	n int64,
+) ([]*Post, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts
+		WHERE room_id = $1 AND serial < $2
+		ORDER BY serial DESC LIMIT $3`,
+		room.ID.Hex(), before, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// Like in DB.GetPostsBefore, fill in the slice starting from the end.
+	posts := make([]*Post, n)
+	i := n - 1
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return posts[i+1:], err
+		}
+		posts[i] = post
+		i--
+		room.fixup(post)
+	}
+	return posts[i+1:], rows.Err()
+}
+
+func (db *PgDB) Search(ctx context.Context, q *SearchQuery, n int64) (*SearchResults, error) {
+	res := &SearchResults{}
+	if q.RoomID.IsZero() {
+		where, args := pgSearchFilter(q, "title", "created")
+		args = append(args, n)
+		rows, err := db.sqldb.QueryContext(ctx,
+			`SELECT `+pgRoomColumns+` FROM rooms WHERE `+where+`
+			ORDER BY ts_rank(to_tsvector('english', title),
+				plainto_tsquery('english', $1)) DESC
+			LIMIT `+fmt.Sprintf("$%d", len(args)),
+			args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			room, err := scanRoom(rows)
+			if err != nil {
+				return nil, err
+			}
+			res.Rooms = append(res.Rooms, room)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	where, args := pgSearchFilter(q, "text", "time")
+	if !q.RoomID.IsZero() {
+		args = append(args, q.RoomID.Hex())
+		where += fmt.Sprintf(` AND room_id = $%d`, len(args))
+	}
+	args = append(args, n)
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT `+pgPostColumns+` FROM posts WHERE `+where+`
+		ORDER BY ts_rank(to_tsvector('english', text),
+			plainto_tsquery('english', $1)) DESC
+		LIMIT `+fmt.Sprintf("$%d", len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		res.Posts = append(res.Posts, post)
+	}
+	return res, rows.Err()
+}
+
+// pgSearchFilter returns a WHERE condition and its arguments for matching q
+// against textCol, with the time range applied to timeCol.
+// The first argument is always q.Text.
+func pgSearchFilter(q *SearchQuery, textCol, timeCol string) (string, []interface{}) {
+	where := `to_tsvector('english', ` + textCol + `) @@ plainto_tsquery('english', $1)`
+	args := []interface{}{q.Text}
+	if q.Author != "" {
+		args = append(args, q.Author)
+		where += fmt.Sprintf(` AND author = $%d`, len(args))
+	}
+	if !q.Since.IsZero() {
+		args = append(args, q.Since)
+		where += fmt.Sprintf(` AND %s >= $%d`, timeCol, len(args))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until)
+		where += fmt.Sprintf(` AND %s < $%d`, timeCol, len(args))
+	}
+	return where, args
+}
+
+func (db *PgDB) MarkRead(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	serial uint64,
+) error {
+	_, err := db.sqldb.ExecContext(ctx,
+		`INSERT INTO reads (user_name, room_id, serial) VALUES ($1, $2, $3)
+		ON CONFLICT (user_name, room_id)
+		DO UPDATE SET serial = GREATEST(reads.serial, excluded.serial)`,
+		user, roomID.Hex(), serial)
+	return err
+}
+
+func (db *PgDB) GetReadMarkers(
+	ctx context.Context,
+	user string,
+	roomIDs []primitive.ObjectID,
+) (map[primitive.ObjectID]uint64, error) {
+	hexes := make([]string, len(roomIDs))
+	for i, id := range roomIDs {
+		hexes[i] = id.Hex()
+	}
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT room_id, serial FROM reads
+		WHERE user_name = $1 AND room_id = ANY($2)`,
+		user, pq.Array(hexes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	markers := make(map[primitive.ObjectID]uint64, len(roomIDs))
+	for rows.Next() {
+		var idHex string
+		var serial uint64
+		if err := rows.Scan(&idHex, &serial); err != nil {
+			return markers, err
+		}
+		id, err := primitive.ObjectIDFromHex(idHex)
+		if err != nil {
+			return markers, err
+		}
+		markers[id] = serial
+	}
+	return markers, rows.Err()
+}
+
+func (db *PgDB) SetWatching(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	watch bool,
+) error {
+	query := `DELETE FROM watches WHERE user_name = $1 AND room_id = $2`
+	if watch {
+		query = `INSERT INTO watches (user_name, room_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`
+	}
+	_, err := db.sqldb.ExecContext(ctx, query, user, roomID.Hex())
+	return err
+}
+
+func (db *PgDB) GetWatchedRooms(ctx context.Context, user string) ([]*Room, error) {
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT `+pgRoomColumns+` FROM rooms
+		WHERE id IN (SELECT room_id FROM watches WHERE user_name = $1)
+		ORDER BY updated DESC`,
+		user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rooms []*Room
+	for rows.Next() {
+		room, err := scanRoom(rows)
+		if err != nil {
+			return rooms, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (db *PgDB) IsWatching(ctx context.Context, user string, roomID primitive.ObjectID) (bool, error) {
+	var watching bool
+	err := db.sqldb.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM watches WHERE user_name = $1 AND room_id = $2)`,
+		user, roomID.Hex(),
+	).Scan(&watching)
+	return watching, err
+}
+
+func (db *PgDB) CreateUser(ctx context.Context, user *User) error {
+	user.ID = primitive.NewObjectID()
+	if err := user.hashPassword(); err != nil {
+		return err
+	}
+	_, err := db.sqldb.ExecContext(ctx,
+		`INSERT INTO users (id, name, password_hash) VALUES ($1, $2, $3)`,
+		user.ID.Hex(), user.Name, user.PasswordHash)
+	if isPgUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	if err != nil {
+		return err
+	}
+	user.clearSensitive()
+	return nil
+}
+
+func (db *PgDB) Authenticate(ctx context.Context, user *User) error {
+	var id string
+	var banned, banUntil sql.NullTime
+	var banBy, banReason string
+	err := db.sqldb.QueryRowContext(ctx,
+		`SELECT id, password_hash, role, banned, ban_until, ban_by, ban_reason
+		FROM users WHERE name = $1`, user.Name,
+	).Scan(&id, &user.PasswordHash, &user.Role, &banned, &banUntil, &banBy, &banReason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBadCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return err
+	}
+	user.Ban = pgBan(banned, banUntil, banBy, banReason)
+	if err := user.checkPassword(); err != nil {
+		return err
+	}
+	user.clearSensitive()
+	return nil
+}
+
+func (db *PgDB) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	var idHex string
+	err := db.sqldb.QueryRowContext(ctx,
+		`SELECT id FROM users WHERE name = $1`, name).Scan(&idHex)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return nil, err
+	}
+	profile := &Profile{Name: name, Joined: id.Timestamp()}
+	err = db.sqldb.QueryRowContext(ctx,
+		`SELECT
+			(SELECT count(*) FROM posts WHERE author = $1 AND deleted IS NULL),
+			(SELECT count(*) FROM rooms WHERE author = $1)`,
+		name).Scan(&profile.Posts, &profile.Rooms)
+	return profile, err
+}
+
+func (db *PgDB) GetPostsByAuthor(
+	ctx context.Context,
+	author string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	return db.findNewestPosts(ctx, `author = $1`, author, cursor, n)
+}
+
+func (db *PgDB) GetPostsMentioning(
+	ctx context.Context,
+	user string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	return db.findNewestPosts(ctx, `$1 = ANY(mentions) AND author <> $1`, user, cursor, n)
+}
+
+// findNewestPosts returns up to n undeleted posts that match where
+// (a condition on $1, which is arg), newest first,
+// starting after cursor (see PostCursor) if it's not empty.
+func (db *PgDB) findNewestPosts(
+	ctx context.Context,
+	where string, arg interface{},
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	query := `SELECT ` + pgPostColumns + ` FROM posts
+		WHERE ` + where + ` AND deleted IS NULL`
+	args := []interface{}{arg, n}
+	if cursor != "" {
+		after, err := parsePostCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		query += ` AND (time, id) < ($3, $4)`
+		args = append(args, after.Time, after.ID.Hex())
+	}
+	query += ` ORDER BY time DESC, id DESC LIMIT $2`
+	rows, err := db.sqldb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []*Post
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return posts, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+func (db *PgDB) GetUser(ctx context.Context, name string) (*User, error) {
+	user := &User{Name: name}
+	var id string
+	var banned, banUntil sql.NullTime
+	var banBy, banReason string
+	err := db.sqldb.QueryRowContext(ctx,
+		`SELECT id, role, banned, ban_until, ban_by, ban_reason
+		FROM users WHERE name = $1`, name,
+	).Scan(&id, &user.Role, &banned, &banUntil, &banBy, &banReason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	user.Ban = pgBan(banned, banUntil, banBy, banReason)
+	return user, nil
+}
+
+// pgBan returns the ban stored in the ban columns of users,
+// or nil if there is none in force.
+func pgBan(banned, banUntil sql.NullTime, by, reason string) *Ban {
+	if !banned.Valid {
+		return nil
+	}
+	ban := &Ban{
+		Time:   banned.Time.UTC(),
+		By:     by,
+		Reason: reason,
+	}
+	if banUntil.Valid {
+		ban.Until = banUntil.Time.UTC()
+	}
+	if !ban.inForce(time.Now()) {
+		return nil
+	}
+	return ban
+}
+
+func (db *PgDB) SetRole(ctx context.Context, name string, role Role) error {
+	return db.updateUser(ctx,
+		`UPDATE users SET role = $2 WHERE name = $1`, name, role)
+}
+
+func (db *PgDB) SetBan(ctx context.Context, name string, ban *Ban) error {
+	if ban == nil {
+		return db.updateUser(ctx,
+			`UPDATE users SET banned = NULL, ban_until = NULL, ban_by = '', ban_reason = ''
+			WHERE name = $1`, name)
+	}
+	var until sql.NullTime
+	if !ban.Until.IsZero() {
+		until = sql.NullTime{Time: ban.Until, Valid: true}
+	}
+	return db.updateUser(ctx,
+		`UPDATE users SET banned = $2, ban_until = $3, ban_by = $4, ban_reason = $5
+		WHERE name = $1`,
+		name, ban.Time, until, ban.By, ban.Reason)
+}
+
+// updateUser executes query, which must update the user whose name is
+// the first argument, and returns ErrNotFound if there is no such user.
+func (db *PgDB) updateUser(ctx context.Context, query string, args ...interface{}) error {
+	res, err := db.sqldb.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db *PgDB) LogModAction(ctx context.Context, action *ModAction) error {
+	action.ID = primitive.NewObjectID()
+	action.Time = time.Now()
+	roomID := ""
+	if !action.RoomID.IsZero() {
+		roomID = action.RoomID.Hex()
+	}
+	_, err := db.sqldb.ExecContext(ctx,
+		`INSERT INTO modlog (id, time, moderator, action, user_name, room_id, serial, note)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		action.ID.Hex(), action.Time, action.Moderator, action.Action,
+		action.User, roomID, action.Serial, action.Note)
+	return err
+}
+
+func (db *PgDB) GetModLog(ctx context.Context, n int64) ([]*ModAction, error) {
+	rows, err := db.sqldb.QueryContext(ctx,
+		`SELECT id, time, moderator, action, user_name, room_id, serial, note
+		FROM modlog ORDER BY time DESC LIMIT $1`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var actions []*ModAction
+	for rows.Next() {
+		action := &ModAction{}
+		var id, roomID string
+		err := rows.Scan(&id, &action.Time, &action.Moderator, &action.Action,
+			&action.User, &roomID, &action.Serial, &action.Note)
+		if err != nil {
+			return actions, err
+		}
+		action.Time = action.Time.UTC()
+		if action.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return actions, err
+		}
+		if roomID != "" {
+			if action.RoomID, err = primitive.ObjectIDFromHex(roomID); err != nil {
+				return actions, err
+			}
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+func isPgUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func (db *PgDB) insertFakePost(ctx context.Context, post *Post) error {
+	post.ID = primitive.NewObjectID()
+	_, err := db.sqldb.ExecContext(ctx,
+		`INSERT INTO posts (id, room_id, serial, author, time, text)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		post.ID.Hex(), post.RoomID.Hex(), post.Serial,
+		post.Author, post.Time, post.Text)
+	return err
+}
+
+func (db *PgDB) replaceFakeRoom(ctx context.Context, room *Room) error {
+	_, err := db.sqldb.ExecContext(ctx,
+		`UPDATE rooms SET title = $2, description = $3, author = $4,
+			created = $5, updated = $6, serial = $7
+		WHERE id = $1`,
+		room.ID.Hex(), room.Title, room.Description, room.Author,
+		room.Created, room.Updated, room.Serial)
+	return err
+}
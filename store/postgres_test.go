@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"os"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestPgDB returns a PgDB in a fresh schema of the database at
+// $NNBB_TEST_POSTGRES (a postgres:// URI), or skips the test if it's not set.
+// The schema is dropped when the test ends.
+func newTestPgDB(t *testing.T) *PgDB {
+	t.Helper()
+	uri := os.Getenv("NNBB_TEST_POSTGRES")
+	if uri == "" {
+		t.Skip("NNBB_TEST_POSTGRES not set")
+	}
+	ctx := context.Background()
+	admin, err := sql.Open("postgres", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "nnbb_test_" + primitive.NewObjectID().Hex()
+	if _, err := admin.ExecContext(ctx, `CREATE SCHEMA `+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.ExecContext(ctx, `DROP SCHEMA `+schema+` CASCADE`); err != nil {
+			t.Errorf("failed to drop schema %s: %v", schema, err)
+		}
+	})
+
+	// lib/pq sends unknown parameters to the server as settings.
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	s, err := ConnectDB(ctx, parsed.String(), NewLocalBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := s.(*PgDB)
+	t.Cleanup(func() {
+		db.CancelStreams()
+		db.Disconnect(ctx)
+	})
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPgCreatePost(t *testing.T)     { testCreatePost(t, newTestPgDB(t)) }
+func TestPgRoomStates(t *testing.T)     { testRoomStates(t, newTestPgDB(t)) }
+func TestPgGetPosts(t *testing.T)       { testGetPosts(t, newTestPgDB(t)) }
+func TestPgEditDeletePost(t *testing.T) { testEditDeletePost(t, newTestPgDB(t)) }
+func TestPgToggleReaction(t *testing.T) { testToggleReaction(t, newTestPgDB(t)) }
+func TestPgStreamRoom(t *testing.T)     { testStreamRoom(t, newTestPgDB(t)) }
+func TestPgAuthenticate(t *testing.T)   { testAuthenticate(t, newTestPgDB(t)) }
+func TestPgGetRoomsByID(t *testing.T)   { testGetRoomsByID(t, newTestPgDB(t)) }
+func TestPgWatching(t *testing.T)       { testWatching(t, newTestPgDB(t)) }
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Profile is public information about a user.
+type Profile struct {
+	Name   string
+	Joined time.Time
+	Posts  int64 // not counting deleted ones
+	Rooms  int64 // created by the user
+}
+
+// PostCursor returns a string that can be passed to GetPostsByAuthor
+// to get the posts that follow post.
+func PostCursor(post *Post) string {
+	return post.ID.Hex() + "." + strconv.FormatInt(post.Time.UnixNano(), 10)
+}
+
+// parsePostCursor returns a Post with just the ID and Time set from cursor.
+func parsePostCursor(cursor string) (*Post, error) {
+	i := strings.IndexByte(cursor, '.')
+	if i < 0 {
+		return nil, ErrBadCursor
+	}
+	id, err := primitive.ObjectIDFromHex(cursor[:i])
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	nsec, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	return &Post{ID: id, Time: time.Unix(0, nsec).UTC()}, nil
+}
+
+// GetProfile returns the profile of the user with name, or ErrNotFound.
+func (db *DB) GetProfile(ctx context.Context, name string) (*Profile, error) {
+	var user User
+	err := db.users.FindOne(ctx, bson.M{"name": name}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	profile := &Profile{
+		Name:   user.Name,
+		Joined: user.ID.Timestamp(),
+	}
+	profile.Posts, err = db.posts.CountDocuments(ctx,
+		bson.M{"author": name, "deleted": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	profile.Rooms, err = db.rooms.CountDocuments(ctx, bson.M{"author": name})
+	return profile, err
+}
+
+// GetPostsByAuthor returns up to n posts by author across all rooms,
+// newest first, starting after the post identified by cursor
+// (see PostCursor), or from the newest post if cursor is empty.
+// Deleted posts are skipped. It returns ErrBadCursor if cursor is malformed.
+func (db *DB) GetPostsByAuthor(
+	ctx context.Context,
+	author string,
+	cursor string,
+	n int64,
+) ([]*Post, error) {
+	filter := bson.M{"author": author, "deleted": bson.M{"$exists": false}}
+	if cursor != "" {
+		after, err := parsePostCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		filter["$or"] = bson.A{
+			bson.M{"time": bson.M{"$lt": after.Time}},
+			bson.M{"time": after.Time, "_id": bson.M{"$lt": after.ID}},
+		}
+	}
+	cur, err := db.posts.Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(n).
+			SetProjection(withoutRevisions))
+	if err != nil {
+		return nil, err
+	}
+	var posts []*Post
+	err = cur.All(ctx, &posts)
+	return posts, err
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reaction is an emoji that a user has reacted with to a post.
+// A user can react to a post with each emoji at most once.
+type Reaction struct {
+	User  string
+	Emoji string
+}
+
+// ToggleReaction adds the reaction of user with emoji to post, or removes it
+// if it's already there, and reports whether it has been added. The post is
+// identified by its ID, and all its fields except Revisions are updated
+// from the database. A deleted post cannot be reacted to: ToggleReaction
+// returns ErrNotFound for it.
+func (db *DB) ToggleReaction(ctx context.Context, post *Post, user, emoji string) (bool, error) {
+	reaction := Reaction{User: user, Emoji: emoji}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(withoutRevisions)
+	// The filter ensures that the reaction is only added once,
+	// atomically with adding it.
+	added := true
+	res := db.posts.FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":       post.ID,
+			"deleted":   bson.M{"$exists": false},
+			"reactions": bson.M{"$not": bson.M{"$elemMatch": reaction}},
+		},
+		bson.M{"$push": bson.M{"reactions": reaction}},
+		opts,
+	)
+	if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+		// Either the reaction is already there, or there is no such post.
+		added = false
+		res = db.posts.FindOneAndUpdate(ctx,
+			bson.M{"_id": post.ID, "deleted": bson.M{"$exists": false}},
+			bson.M{"$pull": bson.M{"reactions": reaction}},
+			opts,
+		)
+	}
+	*post = Post{}
+	err := res.Decode(post)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, ErrNotFound
+	}
+	return added, err
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A read marker is the serial number of the last post in a room
+// that a user has seen.
+
+// MarkRead moves user's read marker in the room with roomID forward to serial.
+// If the marker is already at or past serial, it is left as is.
+func (db *DB) MarkRead(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	serial uint64,
+) error {
+	_, err := db.reads.UpdateOne(ctx,
+		bson.M{"user": user, "roomId": roomID},
+		bson.M{"$max": bson.M{"serial": serial}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetReadMarkers returns user's read markers for the rooms with roomIDs.
+// Rooms that user has never read are missing from the returned map.
+func (db *DB) GetReadMarkers(
+	ctx context.Context,
+	user string,
+	roomIDs []primitive.ObjectID,
+) (map[primitive.ObjectID]uint64, error) {
+	cur, err := db.reads.Find(ctx,
+		bson.M{"user": user, "roomId": bson.M{"$in": roomIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	markers := make(map[primitive.ObjectID]uint64, len(roomIDs))
+	for cur.Next(ctx) {
+		var marker struct {
+			RoomID primitive.ObjectID `bson:"roomId"`
+			Serial uint64
+		}
+		if err := cur.Decode(&marker); err != nil {
+			return markers, err
+		}
+		markers[marker.RoomID] = marker.Serial
+	}
+	return markers, cur.Err()
+}
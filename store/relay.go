@@ -0,0 +1,167 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The relay protocol is simply a stream of JSON-encoded Events
+// sent by the server (ServeRelay) to each client (RelayClient).
+// Clients never send anything.
+
+// relayWriteTimeout limits how long the relay waits for a client
+// to accept each event before giving up on it.
+const relayWriteTimeout = 10 * time.Second
+
+// SplitRelayAddr returns the network and address for dialing or listening on
+// the relay address addr, which is either "unix:" followed by a socket path,
+// or a TCP host:port.
+func SplitRelayAddr(addr string) (network, address string) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// ServeRelay accepts connections on l and sends them all events that pass
+// through broker. It returns when l fails to accept a connection
+// (such as when it's closed).
+func ServeRelay(l net.Listener, broker Broker) error {
+	log.Printf("store: serving relay on %v", l.Addr())
+	rl := &relay{clients: make(map[chan Event]struct{})}
+	go rl.dispatch(broker.Subscribe())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go rl.serve(conn)
+	}
+}
+
+type relay struct {
+	mu      sync.Mutex
+	clients map[chan Event]struct{}
+}
+
+func (rl *relay) dispatch(feed <-chan Event) {
+	for ev := range feed {
+		rl.mu.Lock()
+		for ch := range rl.clients {
+			select {
+			case ch <- ev:
+				// OK
+			default:
+				// This client is not keeping up. Drop it; it will reconnect
+				// and resync its listeners.
+				log.Printf("store: dropping lagging relay client: %v", ch)
+				delete(rl.clients, ch)
+				close(ch)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *relay) serve(conn net.Conn) {
+	defer conn.Close()
+	log.Printf("store: relay client connected from %v", conn.RemoteAddr())
+	ch := make(chan Event, 1024)
+	rl.mu.Lock()
+	rl.clients[ch] = struct{}{}
+	rl.mu.Unlock()
+	defer rl.remove(ch)
+
+	// Clients never send anything, so reading returns only when
+	// the client goes away.
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+			if err := enc.Encode(ev); err != nil {
+				log.Printf("store: failed to relay to %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+		case <-gone:
+			log.Printf("store: relay client disconnected: %v", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+func (rl *relay) remove(ch chan Event) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.clients[ch]; ok {
+		delete(rl.clients, ch)
+		close(ch)
+	}
+}
+
+// RelayClient is a Broker that receives events from a relay server
+// (see ServeRelay).
+type RelayClient struct {
+	addr string
+}
+
+// NewRelayClient returns a RelayClient for the relay server at addr
+// (see SplitRelayAddr). It doesn't connect until Subscribe is called.
+func NewRelayClient(addr string) *RelayClient {
+	return &RelayClient{addr}
+}
+
+// Subscribe connects to the relay server and returns a channel of events
+// from it. If the connection breaks, Subscribe keeps reconnecting in the
+// background. After every (re)connection, the channel receives a Resync event,
+// because events may have been lost in the meantime.
+func (c *RelayClient) Subscribe() <-chan Event {
+	ch := make(chan Event, 16)
+	go c.run(ch)
+	return ch
+}
+
+func (c *RelayClient) run(ch chan<- Event) {
+	network, address := SplitRelayAddr(c.addr)
+	backoff := minStreamBackoff
+	for {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			log.Printf("store: failed to connect to relay (retrying in %v): %v",
+				backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxStreamBackoff {
+				backoff = maxStreamBackoff
+			}
+			continue
+		}
+		log.Printf("store: connected to relay at %v", c.addr)
+		backoff = minStreamBackoff
+		ch <- Event{Type: Resync}
+		dec := json.NewDecoder(conn)
+		for {
+			var ev Event
+			if err := dec.Decode(&ev); err != nil {
+				log.Printf("store: lost connection to relay: %v", err)
+				break
+			}
+			ch <- ev
+		}
+		conn.Close()
+	}
+}
@@ -1,8 +1,12 @@
 package store
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -12,12 +16,56 @@ import (
 )
 
 type Room struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty"`
-	Title   string
-	Author  string
-	Created time.Time
-	Updated time.Time
-	Serial  uint64
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	Title       string
+	Description string `bson:",omitempty"`
+	Author      string
+	Created     time.Time
+	Updated     time.Time
+	Serial      uint64
+	State       RoomState `bson:",omitempty"`
+}
+
+// RoomState determines whether a room accepts new posts.
+type RoomState string
+
+const (
+	// RoomOpen is the normal state of a room.
+	RoomOpen RoomState = ""
+	// RoomLocked rooms accept no new posts, and their posts can't be edited
+	// except by moderators, usually to stop a discussion that went wrong.
+	RoomLocked RoomState = "locked"
+	// RoomArchived rooms are like locked rooms, but it's because
+	// the discussion is over.
+	RoomArchived RoomState = "archived"
+)
+
+var roomStates = []RoomState{RoomOpen, RoomLocked, RoomArchived}
+
+func (state RoomState) String() string {
+	if state == RoomOpen {
+		return "open"
+	}
+	return string(state)
+}
+
+// ParseRoomState returns the RoomState whose String is s.
+func ParseRoomState(s string) (RoomState, error) {
+	for _, state := range roomStates {
+		if s == state.String() {
+			return state, nil
+		}
+	}
+	return "", fmt.Errorf("unknown room state: %q", s)
+}
+
+// RoomClosedError is returned by CreatePost if the room is not open.
+type RoomClosedError struct {
+	State RoomState
+}
+
+func (err *RoomClosedError) Error() string {
+	return "room is " + err.State.String()
 }
 
 // fixup updates fields of room in case post was created after room had already
@@ -31,6 +79,145 @@ func (room *Room) fixup(post *Post) {
 	}
 }
 
+// RoomOrder is the order in which GetRooms returns rooms. Rooms that are equal
+// in this order are further ordered by ID, so that paging is stable.
+type RoomOrder int
+
+const (
+	// ByUpdated puts the most recently updated rooms first.
+	ByUpdated RoomOrder = iota
+	// ByCreated puts the most recently created rooms first.
+	ByCreated
+	// ByPosts puts the rooms with the most posts (highest Serial) first.
+	ByPosts
+	// ByTitle sorts rooms alphabetically (by code point) by title.
+	ByTitle
+)
+
+var roomOrders = []struct {
+	name  string
+	field string // in both MongoDB and PostgreSQL
+	desc  bool
+}{
+	{"updated", "updated", true},
+	{"created", "created", true},
+	{"posts", "serial", true},
+	{"title", "title", false},
+}
+
+func (order RoomOrder) String() string {
+	return roomOrders[order].name
+}
+
+// ParseRoomOrder returns the RoomOrder whose String is s.
+func ParseRoomOrder(s string) (RoomOrder, error) {
+	for i, o := range roomOrders {
+		if s == o.name {
+			return RoomOrder(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown room order: %q", s)
+}
+
+// Cursor returns a string that can be passed to GetRooms (with the same order)
+// to get the rooms that follow room.
+func (order RoomOrder) Cursor(room *Room) string {
+	var key string
+	switch order {
+	case ByUpdated:
+		key = strconv.FormatInt(room.Updated.UnixNano(), 10)
+	case ByCreated:
+		key = strconv.FormatInt(room.Created.UnixNano(), 10)
+	case ByPosts:
+		key = strconv.FormatUint(room.Serial, 10)
+	case ByTitle:
+		key = room.Title
+	}
+	return room.ID.Hex() + "." + key
+}
+
+// parseCursor returns a Room with just enough fields set from cursor
+// to compare it with other rooms in order.
+func (order RoomOrder) parseCursor(cursor string) (*Room, error) {
+	i := strings.IndexByte(cursor, '.')
+	if i < 0 {
+		return nil, ErrBadCursor
+	}
+	key := cursor[i+1:]
+	id, err := primitive.ObjectIDFromHex(cursor[:i])
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	room := &Room{ID: id}
+	switch order {
+	case ByUpdated, ByCreated:
+		var nsec int64
+		nsec, err = strconv.ParseInt(key, 10, 64)
+		room.Updated = time.Unix(0, nsec).UTC()
+		room.Created = room.Updated
+	case ByPosts:
+		room.Serial, err = strconv.ParseUint(key, 10, 64)
+	case ByTitle:
+		room.Title = key
+	}
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	return room, nil
+}
+
+// key returns the value of the field of room by which order sorts.
+func (order RoomOrder) key(room *Room) interface{} {
+	switch order {
+	case ByUpdated:
+		return room.Updated
+	case ByCreated:
+		return room.Created
+	case ByPosts:
+		return room.Serial
+	default:
+		return room.Title
+	}
+}
+
+// before reports whether a comes before b in order.
+func (order RoomOrder) before(a, b *Room) bool {
+	var c int
+	switch order {
+	case ByUpdated:
+		c = compareTime(a.Updated, b.Updated)
+	case ByCreated:
+		c = compareTime(a.Created, b.Created)
+	case ByPosts:
+		switch {
+		case a.Serial < b.Serial:
+			c = -1
+		case a.Serial > b.Serial:
+			c = 1
+		}
+	case ByTitle:
+		c = strings.Compare(a.Title, b.Title)
+	}
+	if c == 0 {
+		c = bytes.Compare(a.ID[:], b.ID[:])
+	}
+	if roomOrders[order].desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
 func (db *DB) CreateRoom(ctx context.Context, room *Room) error {
 	room.ID = primitive.NilObjectID
 	room.Created = time.Now()
@@ -53,9 +240,59 @@ func (db *DB) GetRoom(ctx context.Context, id primitive.ObjectID) (*Room, error)
 	return room, err
 }
 
-func (db *DB) GetRooms(ctx context.Context) ([]*Room, error) {
-	cur, err := db.rooms.Find(ctx, bson.M{},
-		options.Find().SetSort(bson.M{"updated": -1}))
+func (db *DB) GetRoomsByID(
+	ctx context.Context,
+	ids []primitive.ObjectID,
+) (map[primitive.ObjectID]*Room, error) {
+	if len(ids) == 0 {
+		// A nil ids would be null for $in, which is an error.
+		return map[primitive.ObjectID]*Room{}, nil
+	}
+	cur, err := db.rooms.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	var found []*Room
+	if err := cur.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	rooms := make(map[primitive.ObjectID]*Room, len(found))
+	for _, room := range found {
+		rooms[room.ID] = room
+	}
+	return rooms, nil
+}
+
+// GetRooms returns up to n rooms in order, starting after the room
+// identified by cursor (see RoomOrder.Cursor), or from the first room
+// if cursor is empty. It returns ErrBadCursor if cursor is malformed.
+func (db *DB) GetRooms(
+	ctx context.Context,
+	order RoomOrder,
+	cursor string,
+	n int64,
+) ([]*Room, error) {
+	field := roomOrders[order].field
+	dir, cmp := 1, "$gt"
+	if roomOrders[order].desc {
+		dir, cmp = -1, "$lt"
+	}
+	filter := bson.M{}
+	if cursor != "" {
+		after, err := order.parseCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		key := order.key(after)
+		filter = bson.M{"$or": bson.A{
+			bson.M{field: bson.M{cmp: key}},
+			bson.M{field: key, "_id": bson.M{cmp: after.ID}},
+		}}
+	}
+	cur, err := db.rooms.Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: field, Value: dir}, {Key: "_id", Value: dir}}).
+			SetLimit(n))
 	if err != nil {
 		return nil, err
 	}
@@ -71,3 +308,43 @@ func (db *DB) GetRooms(ctx context.Context) ([]*Room, error) {
 	}
 	return rooms, cur.Err()
 }
+
+// SetRoomState changes the state of room, which is identified by its ID.
+// All other fields of room are updated from the database.
+func (db *DB) SetRoomState(ctx context.Context, room *Room, state RoomState) error {
+	update := bson.M{"$set": bson.M{"state": state}}
+	if state == RoomOpen {
+		update = bson.M{"$unset": bson.M{"state": ""}}
+	}
+	res := db.rooms.FindOneAndUpdate(ctx,
+		bson.M{"_id": room.ID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+	*room = Room{}
+	err := res.Decode(room)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// UpdateRoom saves the title and description of room, which is identified
+// by its ID. All other fields of room are updated from the database.
+func (db *DB) UpdateRoom(ctx context.Context, room *Room) error {
+	res := db.rooms.FindOneAndUpdate(ctx,
+		bson.M{"_id": room.ID},
+		bson.M{"$set": bson.M{
+			"title":       room.Title,
+			"description": room.Description,
+			"updated":     time.Now(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	)
+	*room = Room{}
+	err := res.Decode(room)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
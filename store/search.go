@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SearchQuery is what Search looks for.
+type SearchQuery struct {
+	// Text is matched against post text and room titles. The exact rules
+	// (word stemming, stop words, etc.) depend on the backend.
+	Text string
+	// The rest are optional filters. Author and the time range apply to
+	// posts and rooms alike; a room is dated by its creation time.
+	// If RoomID is set, no rooms are returned, only posts in that room.
+	Author       string
+	RoomID       primitive.ObjectID
+	Since, Until time.Time // Until is exclusive
+}
+
+// SearchResults are returned by Search, best matches first.
+// Posts include only a few fields needed to show and link to them:
+// ID, RoomID, Serial, Author, Time, Text.
+type SearchResults struct {
+	Rooms []*Room
+	Posts []*Post
+}
+
+// timeFilter returns a MongoDB filter for q's time range, or nil.
+func (q *SearchQuery) timeFilter() bson.M {
+	filter := bson.M{}
+	if !q.Since.IsZero() {
+		filter["$gte"] = q.Since
+	}
+	if !q.Until.IsZero() {
+		filter["$lt"] = q.Until
+	}
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
+}
+
+// Search returns up to n rooms and up to n posts that match q.
+func (db *DB) Search(ctx context.Context, q *SearchQuery, n int64) (*SearchResults, error) {
+	res := &SearchResults{}
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+
+	if q.RoomID.IsZero() {
+		filter := bson.M{"$text": bson.M{"$search": q.Text}}
+		if q.Author != "" {
+			filter["author"] = q.Author
+		}
+		if tf := q.timeFilter(); tf != nil {
+			filter["created"] = tf
+		}
+		cur, err := db.rooms.Find(ctx, filter,
+			options.Find().SetProjection(score).SetSort(score).SetLimit(n))
+		if err != nil {
+			return nil, err
+		}
+		if err := cur.All(ctx, &res.Rooms); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := bson.M{"$text": bson.M{"$search": q.Text}}
+	if q.Author != "" {
+		filter["author"] = q.Author
+	}
+	if !q.RoomID.IsZero() {
+		filter["roomId"] = q.RoomID
+	}
+	if tf := q.timeFilter(); tf != nil {
+		filter["time"] = tf
+	}
+	cur, err := db.posts.Find(ctx, filter,
+		options.Find().
+			SetProjection(bson.M{
+				"roomId": 1, "serial": 1, "author": 1, "time": 1, "text": 1,
+				"score": score["score"],
+			}).
+			SetSort(score).
+			SetLimit(n))
+	if err != nil {
+		return nil, err
+	}
+	err = cur.All(ctx, &res.Posts)
+	return res, err
+}
@@ -8,32 +8,125 @@ import (
 	"net/url"
 	"strings"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// ConnectDB returns a DB connected to the given MongoDB uri.
-// If stream is true, the returned DB also runs a set of background goroutines
-// that enable streaming new posts via StreamRoom.
-func ConnectDB(ctx context.Context, uri string, stream bool) (*DB, error) {
-	// MongoDB's connection string URIs include database name:
-	// https://docs.mongodb.com/manual/reference/connection-string/ --
-	// but the driver only uses it for authentication. To avoid duplicating
-	// the database name in another config option, extract it manually.
+// Store is the storage for all nnBB data. It is implemented by DB (MongoDB),
+// PgDB (PostgreSQL) and MemDB (in-memory).
+type Store interface {
+	CreateRoom(ctx context.Context, room *Room) error
+	// GetRoom returns nil (and no error) if there is no room with id.
+	GetRoom(ctx context.Context, id primitive.ObjectID) (*Room, error)
+	GetRooms(ctx context.Context, order RoomOrder, cursor string, n int64) ([]*Room, error)
+	// GetRoomsByID returns the rooms with ids, by ID. Rooms that don't exist
+	// are missing from the map.
+	GetRoomsByID(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]*Room, error)
+	// UpdateRoom saves the title and description of room
+	// and bumps its Updated time, as a new post does.
+	UpdateRoom(ctx context.Context, room *Room) error
+	SetRoomState(ctx context.Context, room *Room, state RoomState) error
+
+	// CreatePost returns a *RoomClosedError if the room is not open,
+	// or ErrBadReply if post.ReplyTo is not a post in the room.
+	CreatePost(ctx context.Context, post *Post) error
+	GetPost(ctx context.Context, room *Room, serial uint64) (*Post, error)
+	EditPost(ctx context.Context, post *Post, editor, text string) error
+	DeletePost(ctx context.Context, post *Post, deleter string) error
+	// HasAttachment reports whether any post has an attachment
+	// (or a thumbnail) with blob as its key. Deleted posts have none.
+	HasAttachment(ctx context.Context, blob string) (bool, error)
+	ToggleReaction(ctx context.Context, post *Post, user, emoji string) (bool, error)
+	// GetPostsSince returns the first n posts after since,
+	// or all of them if n <= 0.
+	GetPostsSince(ctx context.Context, room *Room, since uint64, n int64) ([]*Post, error)
+	// GetPostsBefore returns the last n posts before before, in order,
+	// or none if n <= 0.
+	GetPostsBefore(ctx context.Context, room *Room, before uint64, n int64) ([]*Post, error)
+
+	Search(ctx context.Context, q *SearchQuery, n int64) (*SearchResults, error)
+
+	MarkRead(ctx context.Context, user string, roomID primitive.ObjectID, serial uint64) error
+	GetReadMarkers(ctx context.Context, user string, roomIDs []primitive.ObjectID) (map[primitive.ObjectID]uint64, error)
+	SetWatching(ctx context.Context, user string, roomID primitive.ObjectID, watch bool) error
+	GetWatchedRooms(ctx context.Context, user string) ([]*Room, error)
+	IsWatching(ctx context.Context, user string, roomID primitive.ObjectID) (bool, error)
+
+	CreateUser(ctx context.Context, user *User) error
+	Authenticate(ctx context.Context, user *User) error
+	GetProfile(ctx context.Context, name string) (*Profile, error)
+	GetPostsByAuthor(ctx context.Context, author string, cursor string, n int64) ([]*Post, error)
+	GetPostsMentioning(ctx context.Context, user string, cursor string, n int64) ([]*Post, error)
+	GetUser(ctx context.Context, name string) (*User, error)
+
+	SetRole(ctx context.Context, name string, role Role) error
+	SetBan(ctx context.Context, name string, ban *Ban) error
+	LogModAction(ctx context.Context, action *ModAction) error
+	GetModLog(ctx context.Context, n int64) ([]*ModAction, error)
+
+	StreamRoom(roomID primitive.ObjectID, policy Backpressure) chan Event
+	StreamRooms(roomIDs []primitive.ObjectID, policy Backpressure) chan Event
+	StreamMentions(user string, policy Backpressure) chan Event
+	CancelStream(ch chan Event)
+	CancelStreams()
+
+	Disconnect(ctx context.Context)
+}
+
+// ConnectDB returns a Store connected to the given uri. The implementation
+// is chosen by the URI scheme: mongodb:// (or mongodb+srv://) for MongoDB,
+// postgres:// (or postgresql://) for PostgreSQL, mem:// for an in-memory store
+// whose data is lost when the process exits.
+// If broker is not nil, the returned Store also runs a set of background
+// goroutines that enable streaming new posts from broker via StreamRoom,
+// and, if broker is a Publisher, publishing new posts to it.
+func ConnectDB(ctx context.Context, uri string, broker Broker) (Store, error) {
 	parsedURI, err := url.Parse(uri)
 	if err != nil {
 		return nil, fmt.Errorf("store: bad URI: %q: %w", uri, err)
 	}
-	dbname := strings.TrimPrefix(parsedURI.Path, "/")
+	switch parsedURI.Scheme {
+	case "mongodb", "mongodb+srv":
+		db, err := connectMongo(ctx, parsedURI, broker)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "postgres", "postgresql":
+		db, err := connectPostgres(ctx, parsedURI, broker)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "mem":
+		db, err := NewMemDB(broker)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("store: unsupported URI scheme: %q", uri)
+	}
+}
+
+// connectMongo returns a DB connected to the given MongoDB uri.
+func connectMongo(ctx context.Context, uri *url.URL, broker Broker) (*DB, error) {
+	// MongoDB's connection string URIs include database name:
+	// https://docs.mongodb.com/manual/reference/connection-string/ --
+	// but the driver only uses it for authentication. To avoid duplicating
+	// the database name in another config option, extract it manually.
+	dbname := strings.TrimPrefix(uri.Path, "/")
 	if dbname == "" {
 		return nil, fmt.Errorf("store: missing database name in URI: %q", uri)
 	}
 
 	// TODO: timeouts, etc.
-	log.Printf("store: connecting to %v", uri)
+	log.Printf("store: connecting to %v", uri.Redacted())
 	db := &DB{}
+	var err error
 	db.client, err = mongo.Connect(ctx, options.Client().
-		ApplyURI(uri).
+		ApplyURI(uri.String()).
 		SetAppName("nnbb"))
 	if err != nil {
 		return nil, err
@@ -45,26 +138,41 @@ func ConnectDB(ctx context.Context, uri string, stream bool) (*DB, error) {
 	db.users = db.client.Database(dbname).Collection("users")
 	db.rooms = db.client.Database(dbname).Collection("rooms")
 	db.posts = db.client.Database(dbname).Collection("posts")
+	db.reads = db.client.Database(dbname).Collection("reads")
+	db.watches = db.client.Database(dbname).Collection("watches")
+	db.modlog = db.client.Database(dbname).Collection("modlog")
 
-	if stream {
-		db.pump, err = newPump(ctx, db)
-		if err != nil {
-			return nil, err
+	if broker != nil {
+		db.pump = newPump(broker)
+		if pub, ok := broker.(Publisher); ok {
+			db.publisher = pub
+			if err := db.startStream(ctx); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	return db, nil
 }
 
+// DB is a Store backed by a MongoDB replica set.
 type DB struct {
-	client *mongo.Client
-	users  *mongo.Collection
-	rooms  *mongo.Collection
-	posts  *mongo.Collection
+	client     *mongo.Client
+	users      *mongo.Collection
+	rooms      *mongo.Collection
+	posts      *mongo.Collection
+	reads      *mongo.Collection
+	watches    *mongo.Collection
+	modlog     *mongo.Collection
+	publisher  Publisher          // nil if not watching for new posts
+	stopStream context.CancelFunc // nil if not watching for new posts
 	*pump
 }
 
 func (db *DB) Disconnect(ctx context.Context) {
+	if db.stopStream != nil {
+		db.stopStream()
+	}
 	log.Printf("store: disconnecting from MongoDB")
 	if err := db.client.Disconnect(ctx); err != nil {
 		log.Printf("store: failed to disconnect: %v", err)
@@ -75,4 +183,6 @@ var (
 	ErrNotFound       = errors.New("not found")
 	ErrDuplicate      = errors.New("duplicate")
 	ErrBadCredentials = errors.New("bad credentials")
+	ErrBadCursor      = errors.New("bad cursor")
+	ErrBadReply       = errors.New("bad reply")
 )
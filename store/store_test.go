@@ -0,0 +1,489 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The test* functions check the behavior that all Store implementations
+// must share. Each implementation runs them against a fresh db.
+
+// createTestRoom returns a new room in db that has n posts.
+func createTestRoom(t *testing.T, db Store, n int) *Room {
+	t.Helper()
+	ctx := context.Background()
+	room := &Room{Title: "test", Author: "alice"}
+	if err := db.CreateRoom(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		createTestPost(t, db, room, fmt.Sprintf("post %d", i))
+	}
+	room, err := db.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func createTestPost(t *testing.T, db Store, room *Room, text string) *Post {
+	t.Helper()
+	post := &Post{RoomID: room.ID, Author: "alice", Text: text}
+	if err := db.CreatePost(context.Background(), post); err != nil {
+		t.Fatal(err)
+	}
+	return post
+}
+
+func serials(posts []*Post) []uint64 {
+	result := []uint64{}
+	for _, post := range posts {
+		result = append(result, post.Serial)
+	}
+	return result
+}
+
+func serialRange(from, to uint64) []uint64 {
+	result := []uint64{}
+	for serial := from; serial <= to; serial++ {
+		result = append(result, serial)
+	}
+	return result
+}
+
+// receive returns the next event from ch, or fails if there is none soon.
+func receive(t *testing.T, ch chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return ev
+	case <-time.After(2 * resyncInterval):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+// expectNothing fails if ch receives an event soon.
+func expectNothing(t *testing.T, ch chan Event) {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		t.Fatalf("unexpected event: %+v (ok = %v)", ev, ok)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testCreatePost(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 0)
+	for i := uint64(1); i <= 3; i++ {
+		post := createTestPost(t, db, room, "hello")
+		if post.Serial != i {
+			t.Errorf("post %d got serial %d", i, post.Serial)
+		}
+		if post.ID.IsZero() || post.Time.IsZero() {
+			t.Errorf("post %d has no ID or time: %+v", i, post)
+		}
+	}
+	room, err := db.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.Serial != 3 {
+		t.Errorf("room has serial %d, want 3", room.Serial)
+	}
+
+	err = db.CreatePost(ctx, &Post{RoomID: primitive.NewObjectID(), Text: "x"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("post to no room: got %v, want ErrNotFound", err)
+	}
+	err = db.CreatePost(ctx, &Post{RoomID: room.ID, Text: "x", ReplyTo: 4})
+	if !errors.Is(err, ErrBadReply) {
+		t.Errorf("reply to a future post: got %v, want ErrBadReply", err)
+	}
+	reply := &Post{RoomID: room.ID, Author: "bob", Text: "x", ReplyTo: 3}
+	if err := db.CreatePost(ctx, reply); err != nil {
+		t.Errorf("reply to the latest post: %v", err)
+	}
+}
+
+func testRoomStates(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 3)
+	for _, state := range []RoomState{RoomLocked, RoomArchived} {
+		if err := db.SetRoomState(ctx, room, state); err != nil {
+			t.Fatal(err)
+		}
+		if room.State != state {
+			t.Errorf("SetRoomState(%v) left the room %v", state, room.State)
+		}
+		var closed *RoomClosedError
+		err := db.CreatePost(ctx, &Post{RoomID: room.ID, Text: "x"})
+		if !errors.As(err, &closed) || closed.State != state {
+			t.Errorf("post to %v room: got %v, want RoomClosedError", state, err)
+		}
+		// A closed room is reported as such even to a bad reply.
+		err = db.CreatePost(ctx, &Post{RoomID: room.ID, Text: "x", ReplyTo: 10})
+		if !errors.As(err, &closed) {
+			t.Errorf("reply in %v room: got %v, want RoomClosedError", state, err)
+		}
+	}
+	stored, err := db.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != RoomArchived || stored.Serial != 3 {
+		t.Errorf("got room %v with serial %d, want archived with 3", stored.State, stored.Serial)
+	}
+
+	if err := db.SetRoomState(ctx, room, RoomOpen); err != nil {
+		t.Fatal(err)
+	}
+	if post := createTestPost(t, db, room, "reopened"); post.Serial != 4 {
+		t.Errorf("post to reopened room got serial %d, want 4", post.Serial)
+	}
+	err = db.SetRoomState(ctx, &Room{ID: primitive.NewObjectID()}, RoomLocked)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("locking no room: got %v, want ErrNotFound", err)
+	}
+}
+
+func testGetPosts(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 25)
+	tests := []struct {
+		name string
+		get  func() ([]*Post, error)
+		want []uint64
+	}{
+		{"before latest", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 26, 10)
+		}, serialRange(16, 25)},
+		{"before 16", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 16, 10)
+		}, serialRange(6, 15)},
+		{"before 6", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 6, 10)
+		}, serialRange(1, 5)},
+		{"before 1", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 1, 10)
+		}, serialRange(1, 0)},
+		{"before, none", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 26, 0)
+		}, serialRange(1, 0)},
+		{"before, negative", func() ([]*Post, error) {
+			return db.GetPostsBefore(ctx, room, 26, -1)
+		}, serialRange(1, 0)},
+		{"since 0", func() ([]*Post, error) {
+			return db.GetPostsSince(ctx, room, 0, 10)
+		}, serialRange(1, 10)},
+		{"since 20", func() ([]*Post, error) {
+			return db.GetPostsSince(ctx, room, 20, 10)
+		}, serialRange(21, 25)},
+		{"since 20, unlimited", func() ([]*Post, error) {
+			return db.GetPostsSince(ctx, room, 20, 0)
+		}, serialRange(21, 25)},
+		{"since 20, negative", func() ([]*Post, error) {
+			return db.GetPostsSince(ctx, room, 20, -1)
+		}, serialRange(21, 25)},
+		{"since latest", func() ([]*Post, error) {
+			return db.GetPostsSince(ctx, room, 25, 10)
+		}, serialRange(1, 0)},
+	}
+	for _, test := range tests {
+		posts, err := test.get()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := serials(posts); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got serials %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func testEditDeletePost(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 0)
+	post := createTestPost(t, db, room, "first")
+	if err := db.EditPost(ctx, post, "bob", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.EditPost(ctx, post, "alice", "third"); err != nil {
+		t.Fatal(err)
+	}
+	if post.Text != "third" || post.Editor != "alice" || post.Edited.IsZero() {
+		t.Errorf("after edits, got %+v", post)
+	}
+	stored, err := db.GetPost(ctx, room, post.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revs []string
+	for _, rev := range stored.Revisions {
+		revs = append(revs, rev.Editor+": "+rev.Text)
+	}
+	if want := "[alice: first bob: second]"; fmt.Sprint(revs) != want {
+		t.Errorf("got revisions %v, want %v", revs, want)
+	}
+	if stored.Text != "third" {
+		t.Errorf("stored text is %q, want third", stored.Text)
+	}
+
+	if _, err := db.ToggleReaction(ctx, post, "bob", "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeletePost(ctx, post, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if post.Text != "" || post.Deleter != "carol" || post.Deleted.IsZero() || post.Reactions != nil {
+		t.Errorf("after delete, got %+v", post)
+	}
+	stored, err = db.GetPost(ctx, room, post.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Text != "" || stored.Deleted.IsZero() || len(stored.Revisions) > 0 || len(stored.Reactions) > 0 {
+		t.Errorf("deleted post is stored as %+v", stored)
+	}
+	deleted := stored.Deleted
+	if err := db.DeletePost(ctx, post, "dave"); err != nil {
+		t.Errorf("deleting again: %v", err)
+	}
+	if post.Deleter != "carol" || !post.Deleted.Equal(deleted) {
+		t.Errorf("deleting again changed the post to %+v", post)
+	}
+	if err := db.EditPost(ctx, post, "bob", "zombie"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("editing a deleted post: got %v, want ErrNotFound", err)
+	}
+
+	missing := &Post{ID: primitive.NewObjectID(), RoomID: room.ID, Serial: 99}
+	if err := db.EditPost(ctx, missing, "bob", "x"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("editing no post: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeletePost(ctx, missing, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting no post: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetPost(ctx, room, 99); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting no post: got %v, want ErrNotFound", err)
+	}
+}
+
+func testToggleReaction(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 0)
+	post := createTestPost(t, db, room, "hello")
+	for _, step := range []struct {
+		user, emoji string
+		wantAdded   bool
+		want        string
+	}{
+		{"alice", "👍", true, "[{alice 👍}]"},
+		{"bob", "👍", true, "[{alice 👍} {bob 👍}]"},
+		{"alice", "🎉", true, "[{alice 👍} {bob 👍} {alice 🎉}]"},
+		{"alice", "👍", false, "[{bob 👍} {alice 🎉}]"},
+		{"bob", "👍", false, "[{alice 🎉}]"},
+		{"alice", "🎉", false, "[]"},
+	} {
+		added, err := db.ToggleReaction(ctx, post, step.user, step.emoji)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != step.wantAdded {
+			t.Errorf("%s %s: got added = %v", step.user, step.emoji, added)
+		}
+		if got := fmt.Sprint(post.Reactions); got != step.want {
+			t.Errorf("%s %s: got reactions %v, want %v", step.user, step.emoji, got, step.want)
+		}
+		stored, err := db.GetPost(ctx, room, post.Serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(stored.Reactions); got != step.want {
+			t.Errorf("%s %s: stored reactions %v, want %v", step.user, step.emoji, got, step.want)
+		}
+	}
+
+	if err := db.DeletePost(ctx, post, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ToggleReaction(ctx, post, "bob", "👍"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reacting to a deleted post: got %v, want ErrNotFound", err)
+	}
+}
+
+func testStreamRoom(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 0)
+	other := createTestRoom(t, db, 0)
+	ch1 := db.StreamRoom(room.ID, BackpressureResync)
+	ch2 := db.StreamRoom(room.ID, BackpressureResync)
+	chOther := db.StreamRoom(other.ID, BackpressureResync)
+	defer db.CancelStream(ch2)
+	defer db.CancelStream(chOther)
+
+	post := createTestPost(t, db, room, "hello")
+	for _, ch := range []chan Event{ch1, ch2} {
+		ev := receive(t, ch)
+		if ev.Type != PostCreated || ev.Post.ID != post.ID {
+			t.Errorf("got %+v, want PostCreated for %v", ev, post.ID)
+		}
+	}
+	expectNothing(t, chOther)
+
+	db.CancelStream(ch1)
+	select {
+	case ev, ok := <-ch1:
+		if ok {
+			t.Errorf("canceled channel got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("canceled channel not closed")
+	}
+
+	// Every change to the room or its posts reaches ch2, in order.
+	post = createTestPost(t, db, room, "again")
+	changes := []struct {
+		typ    EventType
+		change func() error
+	}{
+		{PostEdited, func() error { return db.EditPost(ctx, post, "alice", "edited") }},
+		{PostReacted, func() error {
+			_, err := db.ToggleReaction(ctx, post, "bob", "👍")
+			return err
+		}},
+		{PostDeleted, func() error { return db.DeletePost(ctx, post, "alice") }},
+		{RoomUpdated, func() error {
+			room.Title = "renamed"
+			return db.UpdateRoom(ctx, room)
+		}},
+		{RoomUpdated, func() error { return db.SetRoomState(ctx, room, RoomLocked) }},
+	}
+	if ev := receive(t, ch2); ev.Type != PostCreated || ev.Post.Serial != post.Serial {
+		t.Errorf("got %+v, want PostCreated for serial %d", ev, post.Serial)
+	}
+	for _, c := range changes {
+		if err := c.change(); err != nil {
+			t.Fatal(err)
+		}
+		ev := receive(t, ch2)
+		if ev.Type != c.typ {
+			t.Errorf("got %v, want %v", ev.Type, c.typ)
+			continue
+		}
+		if c.typ == RoomUpdated {
+			if ev.Room == nil || ev.Room.ID != room.ID || ev.Room.Title != "renamed" {
+				t.Errorf("got %v with room %+v", ev.Type, ev.Room)
+			}
+		} else if ev.Post == nil || ev.Post.ID != post.ID {
+			t.Errorf("got %v with post %+v, want %v", ev.Type, ev.Post, post.ID)
+		}
+	}
+
+	createTestPost(t, db, other, "elsewhere")
+	if ev := receive(t, chOther); ev.Post.RoomID != other.ID {
+		t.Errorf("got post in %v, want %v", ev.Post.RoomID, other.ID)
+	}
+	expectNothing(t, ch2)
+}
+
+func testAuthenticate(t *testing.T, db Store) {
+	ctx := context.Background()
+	if err := db.CreateUser(ctx, &User{Name: "alice", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRole(ctx, "alice", RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	ban := &Ban{Time: time.Now(), Until: time.Now().Add(time.Hour), By: "bob", Reason: "spam"}
+	if err := db.SetBan(ctx, "alice", ban); err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Name: "alice", Password: "secret"}
+	if err := db.Authenticate(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID.IsZero() || user.Role != RoleModerator {
+		t.Errorf("got user %v with role %q, want %q", user.ID, user.Role, RoleModerator)
+	}
+	if user.Ban == nil || user.Ban.By != "bob" || user.Ban.Reason != "spam" {
+		t.Errorf("got ban %+v, want the one set", user.Ban)
+	}
+	if user.Password != "" || user.PasswordHash != "" {
+		t.Error("sensitive fields not cleared")
+	}
+
+	err := db.Authenticate(ctx, &User{Name: "alice", Password: "wrong"})
+	if !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("wrong password: got %v, want ErrBadCredentials", err)
+	}
+	err = db.Authenticate(ctx, &User{Name: "nobody", Password: "secret"})
+	if !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("no user: got %v, want ErrBadCredentials", err)
+	}
+}
+
+func testGetRoomsByID(t *testing.T, db Store) {
+	ctx := context.Background()
+	room1 := createTestRoom(t, db, 2)
+	room2 := createTestRoom(t, db, 0)
+	createTestRoom(t, db, 0)
+	missing := primitive.NewObjectID()
+	rooms, err := db.GetRoomsByID(ctx, []primitive.ObjectID{room1.ID, missing, room2.ID, room1.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 2 || rooms[room1.ID] == nil || rooms[room2.ID] == nil {
+		t.Fatalf("got %v, want rooms %v and %v", rooms, room1.ID, room2.ID)
+	}
+	if got := rooms[room1.ID]; got.ID != room1.ID || got.Serial != 2 || got.Title != room1.Title {
+		t.Errorf("got room %+v, want %+v", got, room1)
+	}
+	if rooms, err := db.GetRoomsByID(ctx, nil); err != nil || len(rooms) != 0 {
+		t.Errorf("no IDs: got %v, %v", rooms, err)
+	}
+}
+
+func testWatching(t *testing.T, db Store) {
+	ctx := context.Background()
+	room := createTestRoom(t, db, 0)
+	other := createTestRoom(t, db, 0)
+	check := func(user string, roomID primitive.ObjectID, want bool) {
+		t.Helper()
+		watching, err := db.IsWatching(ctx, user, roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if watching != want {
+			t.Errorf("IsWatching(%s, %v) = %v, want %v", user, roomID, watching, want)
+		}
+	}
+	check("alice", room.ID, false)
+	for i := 0; i < 2; i++ { // watching twice is the same as once
+		if err := db.SetWatching(ctx, "alice", room.ID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("alice", room.ID, true)
+	check("alice", other.ID, false)
+	check("bob", room.ID, false)
+	rooms, err := db.GetWatchedRooms(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].ID != room.ID {
+		t.Errorf("got watched rooms %v, want only %v", rooms, room.ID)
+	}
+	if err := db.SetWatching(ctx, "alice", room.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	check("alice", room.ID, false)
+}
@@ -3,31 +3,129 @@ package store
 import (
 	"context"
 	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Event is a notification received from a channel returned by StreamRoom.
+type Event struct {
+	Type EventType
+	Post *Post // for PostCreated, PostEdited, PostDeleted, PostReacted
+	Room *Room // for RoomUpdated
+}
+
+// roomID returns the ID of the room that ev concerns.
+func (ev Event) roomID() primitive.ObjectID {
+	if ev.Room != nil {
+		return ev.Room.ID
+	}
+	return ev.Post.RoomID
+}
+
+type EventType int
+
+const (
+	// PostCreated means that a new post has been created in the room.
+	PostCreated EventType = iota
+	// PostEdited means that an existing post has been changed by EditPost.
+	PostEdited
+	// PostDeleted means that an existing post has been replaced
+	// with a tombstone by DeletePost.
+	PostDeleted
+	// RoomUpdated means that the room's title or description
+	// has been changed by UpdateRoom, or its state by SetRoomState.
+	RoomUpdated
+	// Resync means that some events have been dropped because the listener
+	// was not keeping up with them. The listener should refetch any posts
+	// it may have missed, e.g. with GetPostsSince.
+	Resync
+	// PostReacted means that the reactions to an existing post
+	// have been changed by ToggleReaction. (It comes last
+	// because EventType numbers are sent between processes.)
+	PostReacted
+)
+
+// Backpressure is a policy for a listener that is not keeping up with
+// new posts, that is, whose channel buffer is full.
+type Backpressure int
+
+const (
+	// BackpressureClose detaches the listener and closes its channel.
+	BackpressureClose Backpressure = iota
+	// BackpressureResync drops new events while the buffer is full,
+	// and sends a Resync event as soon as there is room again.
+	BackpressureResync
+	// BackpressureCoalesce immediately replaces all events in the buffer
+	// with a single Resync event.
+	BackpressureCoalesce
+)
+
+var backpressureNames = []string{"close", "resync", "coalesce"}
+
+func (b Backpressure) String() string {
+	return backpressureNames[b]
+}
+
+// ParseBackpressure returns the Backpressure whose String is s.
+func ParseBackpressure(s string) (Backpressure, error) {
+	for i, name := range backpressureNames {
+		if s == name {
+			return Backpressure(i), nil
+		}
+	}
+	return 0, fmt.Errorf("store: bad backpressure policy: %q", s)
+}
+
+// backpressureStats counts how often listeners fall behind, by outcome:
+// "closed", "dropped" (events under BackpressureResync), "resynced"
+// (Resync events sent under BackpressureResync), "coalesced".
+var backpressureStats = expvar.NewMap("store.backpressure")
+
 // StreamRoom returns a channel that will receive all new posts to roomID.
-// This channel will be closed when its buffer fills up (so it must be read
-// in a timely manner) or after a call to CancelStream or CancelStreams.
+// The channel has a limited buffer, so it must be read in a timely manner;
+// what happens when the buffer fills up is determined by policy.
+// The channel will be closed after a call to CancelStream or CancelStreams
+// (or earlier, under BackpressureClose).
 // Callers must not close the channel themselves.
 //
-// StreamRoom panics if the stream parameter passed to ConnectDB was false.
-func (db *DB) StreamRoom(roomID primitive.ObjectID) chan *Post {
-	if db.pump == nil {
-		panic("store: StreamRoom called on DB without pump")
+// StreamRoom panics if the Store was connected with a nil broker.
+func (pump *pump) StreamRoom(roomID primitive.ObjectID, policy Backpressure) chan Event {
+	return pump.StreamRooms([]primitive.ObjectID{roomID}, policy)
+}
+
+// StreamRooms is like StreamRoom, but the channel receives events from all
+// rooms with roomIDs.
+func (pump *pump) StreamRooms(roomIDs []primitive.ObjectID, policy Backpressure) chan Event {
+	if pump == nil {
+		panic("store: StreamRooms called on DB without pump")
+	}
+	ch := make(chan Event, 128)
+	pump.listeners <- listener{attach: true, ch: ch, roomIDs: roomIDs, policy: policy}
+	return ch
+}
+
+// StreamMentions is like StreamRoom, but the channel receives PostCreated
+// events for posts that mention user (see Post.Mentions), except user's own.
+func (pump *pump) StreamMentions(user string, policy Backpressure) chan Event {
+	if pump == nil {
+		panic("store: StreamMentions called on DB without pump")
 	}
-	ch := make(chan *Post, 128)
-	db.pump.listeners <- listener{true, ch, roomID}
+	ch := make(chan Event, 128)
+	pump.listeners <- listener{attach: true, ch: ch, user: user, policy: policy}
 	return ch
 }
 
 // CancelStream requests db to stop streaming new posts to ch, and close it.
-func (db *DB) CancelStream(ch chan *Post) {
-	db.pump.listeners <- listener{attach: false, ch: ch}
+func (pump *pump) CancelStream(ch chan Event) {
+	pump.listeners <- listener{attach: false, ch: ch}
 }
 
 // CancelStreams requests db to close all channels returned by StreamRoom,
@@ -35,13 +133,13 @@ func (db *DB) CancelStream(ch chan *Post) {
 // in order to gracefully interrupt long-lived user connections without breaking
 // the short-lived user requests that are currently in flight.
 //
-// CancelStreams panics if the stream parameter passed to ConnectDB was false.
-func (db *DB) CancelStreams() {
-	if db.pump == nil {
+// CancelStreams panics if the Store was connected with a nil broker.
+func (pump *pump) CancelStreams() {
+	if pump == nil {
 		panic("store: CancelStreams called on DB without pump")
 	}
 	select {
-	case db.pump.cancel <- struct{}{}:
+	case pump.cancel <- struct{}{}:
 		// OK
 	default:
 		// This may happen if CancelStreams is called multiple times.
@@ -51,92 +149,285 @@ func (db *DB) CancelStreams() {
 }
 
 // pump dispatches new posts to listeners (SSE handlers).
-// DB communicates with pump only by sending on the pump's channels.
+// A Store communicates with pump only by sending on the pump's channels.
+// New posts are fed into the pump by a Broker.
 type pump struct {
-	db        *DB
-	posts     chan *Post
+	feed      <-chan Event
 	listeners chan listener
 	cancel    chan struct{}
 
 	// byRoom is for sending a new post to everyone listening to the room.
-	byRoom map[primitive.ObjectID]map[chan *Post]struct{}
-	// byChannel is for locating the room ID to detach a listener.
-	byChannel map[chan *Post]primitive.ObjectID
+	byRoom map[primitive.ObjectID]map[chan Event]*listener
+	// byUser is for sending a new post to everyone listening
+	// to mentions of a user.
+	byUser map[string]map[chan Event]*listener
+	// byChannel is for locating the listener to detach it.
+	byChannel map[chan Event]*listener
+	// lagging are listeners that owe a Resync event.
+	lagging map[chan Event]*listener
 }
 
+// listener is a request to attach or detach a listener,
+// and also the state of an attached listener.
 type listener struct {
-	attach bool // false means detach an existing listener
-	ch     chan *Post
-	roomID primitive.ObjectID
+	attach  bool // false means detach an existing listener
+	ch      chan Event
+	roomIDs []primitive.ObjectID
+	user    string // whose mentions to listen to, if any
+	policy  Backpressure
+	lagging bool // under BackpressureResync, ch owes a Resync event
 }
 
-func newPump(ctx context.Context, db *DB) (*pump, error) {
+func newPump(broker Broker) *pump {
 	log.Print("store: initializing pump")
 	pump := &pump{
-		db:        db,
-		posts:     make(chan *Post),
+		feed:      broker.Subscribe(),
 		listeners: make(chan listener),
 		cancel:    make(chan struct{}, 1),
-		byRoom:    make(map[primitive.ObjectID]map[chan *Post]struct{}),
-		byChannel: make(map[chan *Post]primitive.ObjectID),
-	}
-	if err := pump.startStream(ctx); err != nil {
-		return nil, err
+		byRoom:    make(map[primitive.ObjectID]map[chan Event]*listener),
+		byUser:    make(map[string]map[chan Event]*listener),
+		byChannel: make(map[chan Event]*listener),
+		lagging:   make(map[chan Event]*listener),
 	}
 	go pump.run()
-	return pump, nil
+	return pump
 }
 
-func (pump *pump) startStream(ctx context.Context) error {
+// Bounds for the delay before reopening a broken change stream
+// (or reconnecting to a relay).
+const (
+	minStreamBackoff = 1 * time.Second
+	maxStreamBackoff = 1 * time.Minute
+)
+
+// startStream opens a change stream of new posts (and other changes that
+// listeners care about) and starts publishing them
+// to db.publisher. If the change stream breaks later (e.g. due to a replica set
+// election), it is reopened from the last seen resume token, so listeners
+// stay attached and don't miss any posts. The stream runs until Disconnect.
+func (db *DB) startStream(ctx context.Context) error {
 	log.Print("store: starting change stream")
-	cs, err := pump.db.posts.Watch(ctx,
-		[]bson.M{{"$match": bson.M{"operationType": "insert"}}},
-	)
+	ctx, db.stopStream = context.WithCancel(ctx)
+	cs, err := db.watch(ctx, nil)
 	if err != nil {
+		db.stopStream()
 		return err
 	}
-	go pump.runStream(ctx, cs)
+	go db.runStream(ctx, cs)
 	return nil
 }
 
-func (pump *pump) runStream(ctx context.Context, cs *mongo.ChangeStream) {
-	for cs.Next(ctx) {
-		var data struct {
-			Post *Post `bson:"fullDocument"`
+// watch opens a change stream of new and changed posts, and of changes to
+// room titles, descriptions and states. (Rooms are also updated with every new post,
+// but those changes are of no interest here.) If resumeToken is not nil,
+// the stream starts right after the event it identifies.
+func (db *DB) watch(ctx context.Context, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return db.posts.Database().Watch(ctx,
+		[]bson.M{{"$match": bson.M{"$or": bson.A{
+			bson.M{
+				"ns.coll":       db.posts.Name(),
+				"operationType": bson.M{"$in": bson.A{"insert", "update", "replace"}},
+			},
+			bson.M{
+				"ns.coll":       db.rooms.Name(),
+				"operationType": "update",
+				"$or": bson.A{
+					bson.M{"updateDescription.updatedFields.title": bson.M{"$exists": true}},
+					bson.M{"updateDescription.updatedFields.description": bson.M{"$exists": true}},
+					bson.M{"updateDescription.updatedFields.state": bson.M{"$exists": true}},
+					bson.M{"updateDescription.removedFields": "state"},
+				},
+			},
+		}}}},
+		opts,
+	)
+}
+
+func (db *DB) runStream(ctx context.Context, cs *mongo.ChangeStream) {
+	var resumeToken bson.Raw
+	for {
+		resumeToken = db.consumeStream(ctx, cs, resumeToken)
+		cs = db.reopenStream(ctx, resumeToken)
+		if cs == nil {
+			log.Print("store: change stream stopped for good")
+			return
 		}
-		err := cs.Decode(&data)
-		if err != nil {
+	}
+}
+
+// consumeStream publishes events from cs until cs breaks. Then it
+// closes cs and returns the token to resume from (or resumeToken if cs
+// didn't provide any).
+func (db *DB) consumeStream(
+	ctx context.Context,
+	cs *mongo.ChangeStream,
+	resumeToken bson.Raw,
+) bson.Raw {
+	if token := cs.ResumeToken(); token != nil {
+		resumeToken = token
+	}
+	for cs.Next(ctx) {
+		if err := db.publishChange(cs); err != nil {
 			log.Printf("store: failed to decode data from change stream: %v", err)
-			continue
 		}
-		pump.posts <- data.Post
+		resumeToken = cs.ResumeToken()
 	}
 	log.Printf("store: change stream ended: %v", cs.Err())
-	cs.Close(ctx)
-	close(pump.posts)
+	if token := cs.ResumeToken(); token != nil {
+		resumeToken = token
+	}
+	// ctx may be canceled by now, but we still want to kill the cursor.
+	cs.Close(context.Background())
+	return resumeToken
 }
 
+// publishChange publishes the event for the current change in cs, if any.
+func (db *DB) publishChange(cs *mongo.ChangeStream) error {
+	var data struct {
+		OperationType     string   `bson:"operationType"`
+		Document          bson.Raw `bson:"fullDocument"`
+		UpdateDescription struct {
+			UpdatedFields bson.Raw `bson:"updatedFields"`
+		} `bson:"updateDescription"`
+		NS struct {
+			Coll string
+		} `bson:"ns"`
+	}
+	if err := cs.Decode(&data); err != nil {
+		return err
+	}
+	if data.Document == nil {
+		// The document has been deleted from the collection
+		// by the time the update was looked up.
+		return nil
+	}
+
+	if data.NS.Coll == db.rooms.Name() {
+		room := &Room{}
+		if err := bson.Unmarshal(data.Document, room); err != nil {
+			return err
+		}
+		db.publisher.Publish(Event{Type: RoomUpdated, Room: room})
+		return nil
+	}
+
+	post := &Post{}
+	if err := bson.Unmarshal(data.Document, post); err != nil {
+		return err
+	}
+	switch {
+	case data.OperationType == "insert":
+		db.publisher.Publish(Event{Type: PostCreated, Post: post})
+	case !post.Deleted.IsZero():
+		db.publisher.Publish(Event{Type: PostDeleted, Post: post})
+	case onlyReactions(data.UpdateDescription.UpdatedFields):
+		post.Revisions = nil
+		db.publisher.Publish(Event{Type: PostReacted, Post: post})
+	default:
+		post.Revisions = nil // listeners don't need them
+		db.publisher.Publish(Event{Type: PostEdited, Post: post})
+	}
+	return nil
+}
+
+// onlyReactions reports whether the updatedFields of a change
+// to a post are all in Post.Reactions (see ToggleReaction).
+func onlyReactions(updatedFields bson.Raw) bool {
+	elems, err := updatedFields.Elements()
+	if err != nil || len(elems) == 0 {
+		return false
+	}
+	for _, elem := range elems {
+		key := elem.Key()
+		if key != "reactions" && !strings.HasPrefix(key, "reactions.") {
+			return false
+		}
+	}
+	return true
+}
+
+// reopenStream tries to reopen the change stream from resumeToken, with
+// exponential backoff, until it succeeds or ctx is canceled (in which case
+// it returns nil).
+func (db *DB) reopenStream(ctx context.Context, resumeToken bson.Raw) *mongo.ChangeStream {
+	backoff := minStreamBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		log.Printf("store: reopening change stream (resume token: %v)", resumeToken)
+		cs, err := db.watch(ctx, resumeToken)
+		if err == nil {
+			return cs
+		}
+		if isHistoryLost(err) {
+			// The oplog no longer reaches back to our resume token,
+			// so the best we can do is to start from the current time,
+			// and have listeners refetch whatever they have missed.
+			log.Printf("store: cannot resume change stream, posts may be lost: %v", err)
+			resumeToken = nil
+			db.publisher.Publish(Event{Type: Resync})
+			continue
+		}
+		log.Printf("store: failed to reopen change stream: %v", err)
+		backoff *= 2
+		if backoff > maxStreamBackoff {
+			backoff = maxStreamBackoff
+		}
+	}
+}
+
+// isHistoryLost returns true if err means that a change stream
+// cannot be resumed from the given token.
+func isHistoryLost(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	const (
+		changeStreamFatalError  = 280
+		changeStreamHistoryLost = 286
+	)
+	return cmdErr.Code == changeStreamFatalError ||
+		cmdErr.Code == changeStreamHistoryLost
+}
+
+// resyncInterval is how often the pump retries sending Resync events
+// to lagging listeners, in case no new posts arrive to trigger it.
+const resyncInterval = 1 * time.Second
+
 func (pump *pump) run() {
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
 	var err error
 loop:
 	for {
 		select {
-		case post := <-pump.posts:
-			if post == nil {
-				err = errors.New("change stream ended")
+		case ev, ok := <-pump.feed:
+			if !ok {
+				err = errors.New("feed ended")
 				break loop
 			}
-			for ch := range pump.byRoom[post.RoomID] {
-				pump.trySend(ch, post)
-			}
+			pump.dispatch(ev)
 
 		case l := <-pump.listeners:
 			if l.attach {
-				pump.attachListener(l.ch, l.roomID)
+				pump.attachListener(l)
 			} else {
 				pump.detachListener(l.ch)
 			}
 
+		case <-ticker.C:
+			for _, l := range pump.lagging {
+				pump.tryResync(l)
+			}
+
 		case <-pump.cancel:
 			err = errors.New("asked to cancel")
 			break loop
@@ -144,6 +435,11 @@ loop:
 	}
 
 	log.Printf("store: pump winding down: %v", err)
+	// Keep draining the feed, so as not to block the Broker.
+	go func() {
+		for range pump.feed {
+		}
+	}()
 	for ch := range pump.byChannel {
 		pump.detachListener(ch)
 	}
@@ -154,42 +450,132 @@ loop:
 	// more than once per process), but is ugly nonetheless.
 	for l := range pump.listeners {
 		if l.attach { // have to go through this to avoid double-close
-			pump.attachListener(l.ch, l.roomID)
+			pump.attachListener(l)
 		}
 		pump.detachListener(l.ch)
 	}
 }
 
-func (pump *pump) attachListener(ch chan *Post, roomID primitive.ObjectID) {
-	log.Printf("store: attaching listener: %v", ch)
-	inRoom := pump.byRoom[roomID]
-	if inRoom == nil {
-		inRoom = make(map[chan *Post]struct{})
-		pump.byRoom[roomID] = inRoom
+// dispatch sends ev to the listeners it concerns.
+func (pump *pump) dispatch(ev Event) {
+	switch ev.Type {
+	case Resync:
+		// Events may have been lost before they reached us,
+		// so every listener may have missed something.
+		for _, l := range pump.byChannel {
+			pump.trySend(l, ev)
+		}
+	default:
+		for _, l := range pump.byRoom[ev.roomID()] {
+			pump.trySend(l, ev)
+		}
 	}
-	inRoom[ch] = struct{}{}
-	pump.byChannel[ch] = roomID
+	if ev.Type == PostCreated {
+		for _, name := range ev.Post.Mentions {
+			if name == ev.Post.Author {
+				continue
+			}
+			for _, l := range pump.byUser[name] {
+				pump.trySend(l, ev)
+			}
+		}
+	}
+}
+
+func (pump *pump) attachListener(l listener) {
+	log.Printf("store: attaching listener: %v (%v)", l.ch, l.policy)
+	for _, roomID := range l.roomIDs {
+		inRoom := pump.byRoom[roomID]
+		if inRoom == nil {
+			inRoom = make(map[chan Event]*listener)
+			pump.byRoom[roomID] = inRoom
+		}
+		inRoom[l.ch] = &l
+	}
+	if l.user != "" {
+		mentioned := pump.byUser[l.user]
+		if mentioned == nil {
+			mentioned = make(map[chan Event]*listener)
+			pump.byUser[l.user] = mentioned
+		}
+		mentioned[l.ch] = &l
+	}
+	pump.byChannel[l.ch] = &l
 }
 
-func (pump *pump) detachListener(ch chan *Post) {
-	if roomID, ok := pump.byChannel[ch]; ok {
+func (pump *pump) detachListener(ch chan Event) {
+	if l, ok := pump.byChannel[ch]; ok {
 		log.Printf("store: detaching listener: %v", ch)
-		delete(pump.byRoom[roomID], ch)
+		for _, roomID := range l.roomIDs {
+			delete(pump.byRoom[roomID], ch)
+			if len(pump.byRoom[roomID]) == 0 {
+				delete(pump.byRoom, roomID)
+			}
+		}
+		if l.user != "" {
+			delete(pump.byUser[l.user], ch)
+			if len(pump.byUser[l.user]) == 0 {
+				delete(pump.byUser, l.user)
+			}
+		}
 		delete(pump.byChannel, ch)
+		delete(pump.lagging, ch)
 		close(ch)
 	}
 }
 
-// trySend attempts to send post to an attached listener.
-// If the listener's buffer is full, trySend detaches it.
-func (pump *pump) trySend(ch chan *Post, post *Post) {
+// trySend attempts to send ev to an attached listener.
+// If the listener's buffer is full, trySend applies the listener's policy.
+func (pump *pump) trySend(l *listener, ev Event) {
+	if l.lagging && !pump.tryResync(l) {
+		backpressureStats.Add("dropped", 1)
+		return
+	}
 	select {
-	case ch <- post:
-		// OK
+	case l.ch <- ev:
+		return
 	default:
-		log.Printf("store: detaching dead listener: %v", ch)
-		delete(pump.byRoom[post.RoomID], ch)
-		delete(pump.byChannel, ch)
-		close(ch)
+	}
+
+	switch l.policy {
+	case BackpressureResync:
+		log.Printf("store: listener fell behind, dropping events: %v", l.ch)
+		backpressureStats.Add("dropped", 1)
+		l.lagging = true
+		pump.lagging[l.ch] = l
+
+	case BackpressureCoalesce:
+		log.Printf("store: listener fell behind, coalescing events: %v", l.ch)
+		backpressureStats.Add("coalesced", 1)
+		// Only the pump sends on l.ch, so once we've drained it,
+		// there is certainly room for the Resync event.
+	drain:
+		for {
+			select {
+			case <-l.ch:
+			default:
+				break drain
+			}
+		}
+		l.ch <- Event{Type: Resync}
+
+	default:
+		log.Printf("store: detaching dead listener: %v", l.ch)
+		backpressureStats.Add("closed", 1)
+		pump.detachListener(l.ch)
+	}
+}
+
+// tryResync attempts to send a Resync event to a lagging listener,
+// returning true if it succeeded.
+func (pump *pump) tryResync(l *listener) bool {
+	select {
+	case l.ch <- Event{Type: Resync}:
+		backpressureStats.Add("resynced", 1)
+		l.lagging = false
+		delete(pump.lagging, l.ch)
+		return true
+	default:
+		return false
 	}
 }
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testPump is a pump fed directly by the test.
+type testPump struct {
+	*pump
+	broker *LocalBroker
+	fence  chan Event // listens to fenceRoom
+}
+
+var fenceRoom = primitive.NewObjectID()
+
+func newTestPump(t *testing.T) *testPump {
+	broker := NewLocalBroker()
+	p := &testPump{pump: newPump(broker), broker: broker}
+	p.fence = p.StreamRoom(fenceRoom, BackpressureClose)
+	t.Cleanup(p.CancelStreams)
+	return p
+}
+
+// publish sends n new posts to roomID through the pump, and waits until
+// the pump has dispatched them.
+func (p *testPump) publish(t *testing.T, roomID primitive.ObjectID, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		p.broker.Publish(Event{Type: PostCreated, Post: &Post{RoomID: roomID, Serial: uint64(i + 1)}})
+	}
+	p.broker.Publish(Event{Type: PostCreated, Post: &Post{RoomID: fenceRoom}})
+	receive(t, p.fence)
+}
+
+// drain returns the types of all events buffered in ch,
+// and whether ch has been closed.
+func drain(ch chan Event) (types []EventType, closed bool) {
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return types, true
+			}
+			types = append(types, ev.Type)
+		default:
+			return types, false
+		}
+	}
+}
+
+func count(types []EventType, typ EventType) int {
+	n := 0
+	for _, t := range types {
+		if t == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBackpressureClose(t *testing.T) {
+	p := newTestPump(t)
+	room := primitive.NewObjectID()
+	ch := p.StreamRoom(room, BackpressureClose)
+	p.publish(t, room, cap(ch)+1)
+	types, closed := drain(ch)
+	if !closed {
+		t.Error("channel not closed")
+	}
+	if len(types) != cap(ch) || count(types, PostCreated) != cap(ch) {
+		t.Errorf("got %d events (%v), want the first %d posts", len(types), types, cap(ch))
+	}
+}
+
+func TestBackpressureResync(t *testing.T) {
+	p := newTestPump(t)
+	room := primitive.NewObjectID()
+	ch := p.StreamRoom(room, BackpressureResync)
+	defer p.CancelStream(ch)
+	p.publish(t, room, cap(ch)+5)
+	types, closed := drain(ch)
+	if closed {
+		t.Fatal("channel closed")
+	}
+	if len(types) != cap(ch) || count(types, PostCreated) != cap(ch) {
+		t.Errorf("got %d events (%v), want the first %d posts", len(types), types, cap(ch))
+	}
+	// The next post comes after the Resync that the listener is owed.
+	p.publish(t, room, 1)
+	types, _ = drain(ch)
+	if len(types) != 2 || types[0] != Resync || types[1] != PostCreated {
+		t.Errorf("after catching up, got %v, want Resync and PostCreated", types)
+	}
+}
+
+func TestBackpressureResyncTicker(t *testing.T) {
+	p := newTestPump(t)
+	room := primitive.NewObjectID()
+	ch := p.StreamRoom(room, BackpressureResync)
+	defer p.CancelStream(ch)
+	p.publish(t, room, cap(ch)+1)
+	drain(ch)
+	// Without new posts, the Resync comes within resyncInterval.
+	if ev := receive(t, ch); ev.Type != Resync {
+		t.Errorf("got %v, want Resync", ev.Type)
+	}
+}
+
+func TestBackpressureCoalesce(t *testing.T) {
+	p := newTestPump(t)
+	room := primitive.NewObjectID()
+	ch := p.StreamRoom(room, BackpressureCoalesce)
+	defer p.CancelStream(ch)
+	p.publish(t, room, cap(ch)+1)
+	types, closed := drain(ch)
+	if closed {
+		t.Fatal("channel closed")
+	}
+	if len(types) != 1 || types[0] != Resync {
+		t.Errorf("got %v, want a single Resync", types)
+	}
+	p.publish(t, room, 1)
+	types, _ = drain(ch)
+	if len(types) != 1 || types[0] != PostCreated {
+		t.Errorf("after catching up, got %v, want PostCreated", types)
+	}
+}
+
+func TestBackpressureOthersUnaffected(t *testing.T) {
+	p := newTestPump(t)
+	room := primitive.NewObjectID()
+	slow := p.StreamRoom(room, BackpressureClose)
+	fast := p.StreamRoom(room, BackpressureClose)
+	defer p.CancelStream(fast)
+	for i := 0; i < cap(fast)+1; i++ {
+		p.publish(t, room, 1)
+		if ev := receive(t, fast); ev.Type != PostCreated {
+			t.Fatalf("got %v, want PostCreated", ev.Type)
+		}
+	}
+	if _, closed := drain(slow); !closed {
+		t.Error("slow channel not closed")
+	}
+}
@@ -16,6 +16,8 @@ type User struct {
 	Name         string
 	Password     string `bson:"-"`
 	PasswordHash string `bson:"passwordHash"`
+	Role         Role   `bson:",omitempty"`
+	Ban          *Ban   `bson:",omitempty"` // nil if not banned
 }
 
 func (u *User) clearSensitive() {
@@ -24,14 +26,33 @@ func (u *User) clearSensitive() {
 	u.PasswordHash = ""
 }
 
-func (db *DB) CreateUser(ctx context.Context, user *User) error {
-	user.ID = primitive.NilObjectID
-	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password),
+// hashPassword fills user.PasswordHash from user.Password.
+func (u *User) hashPassword() error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(u.Password),
 		bcrypt.DefaultCost)
 	if err != nil {
 		return fmt.Errorf("store: cannot generate password hash: %w", err)
 	}
-	user.PasswordHash = string(hash)
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// checkPassword returns ErrBadCredentials if user.Password
+// does not match user.PasswordHash.
+func (u *User) checkPassword() error {
+	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash),
+		[]byte(u.Password))
+	if err != nil {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+func (db *DB) CreateUser(ctx context.Context, user *User) error {
+	user.ID = primitive.NilObjectID
+	if err := user.hashPassword(); err != nil {
+		return err
+	}
 	res, err := db.users.InsertOne(ctx, user)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
@@ -55,10 +76,8 @@ func (db *DB) Authenticate(ctx context.Context, user *User) error {
 	if err != nil {
 		return err
 	}
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash),
-		[]byte(user.Password))
-	if err != nil {
-		return ErrBadCredentials
+	if err := user.checkPassword(); err != nil {
+		return err
 	}
 	user.clearSensitive()
 	return nil
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SetWatching makes user watch (or stop watching) the room with roomID.
+func (db *DB) SetWatching(
+	ctx context.Context,
+	user string,
+	roomID primitive.ObjectID,
+	watch bool,
+) error {
+	filter := bson.M{"user": user, "roomId": roomID}
+	if !watch {
+		_, err := db.watches.DeleteOne(ctx, filter)
+		return err
+	}
+	_, err := db.watches.UpdateOne(ctx, filter,
+		bson.M{"$setOnInsert": filter},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// GetWatchedRooms returns the rooms that user watches,
+// most recently updated first.
+func (db *DB) GetWatchedRooms(ctx context.Context, user string) ([]*Room, error) {
+	cur, err := db.watches.Find(ctx, bson.M{"user": user})
+	if err != nil {
+		return nil, err
+	}
+	var watches []struct {
+		RoomID primitive.ObjectID `bson:"roomId"`
+	}
+	if err := cur.All(ctx, &watches); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(watches))
+	for i, w := range watches {
+		ids[i] = w.RoomID
+	}
+
+	cur, err = db.rooms.Find(ctx, bson.M{"_id": bson.M{"$in": ids}},
+		options.Find().SetSort(bson.M{"updated": -1}))
+	if err != nil {
+		return nil, err
+	}
+	var rooms []*Room
+	err = cur.All(ctx, &rooms)
+	return rooms, err
+}
+
+// IsWatching reports whether user watches the room with roomID.
+func (db *DB) IsWatching(ctx context.Context, user string, roomID primitive.ObjectID) (bool, error) {
+	n, err := db.watches.CountDocuments(ctx,
+		bson.M{"user": user, "roomId": roomID},
+		options.Count().SetLimit(1))
+	return n > 0, err
+}
@@ -163,8 +163,9 @@ func (b *bot) rooms() {
 }
 
 var (
-	markExp    = regexp.MustCompile(`\$[0-9a-f]{12}`)
-	eventIDExp = regexp.MustCompile(`(?m)^id: (.+)$`)
+	markExp      = regexp.MustCompile(`\$[0-9a-f]{12}`)
+	eventIDExp   = regexp.MustCompile(`(?m)^id: (.+)$`)
+	eventNameExp = regexp.MustCompile(`(?m)^event: `)
 )
 
 func (b *bot) room() {
@@ -265,6 +266,10 @@ func (b *bot) streamUpdates(ctx context.Context, ch chan<- string, req *http.Req
 		sc.Split(scanMessages)
 		for sc.Scan() {
 			msg := sc.Bytes()
+			if eventNameExp.Match(msg) {
+				// Not a new post, but a notice about an existing one.
+				continue
+			}
 			mark := string(markExp.Find(msg))
 			if match := eventIDExp.FindSubmatch(msg); match != nil {
 				lastID = string(match[1])
@@ -0,0 +1,610 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The JSON API under /api/v1/ mirrors the HTML routes for non-browser clients.
+// Requests with a body must send it as JSON. Errors are returned as
+// {"error": {"code": ..., "message": ...}} with a matching HTTP status.
+
+func (s *Server) routeAPI(r *httprouter.Router) {
+	r.GET("/api/v1/session/", s.apiGetSession)
+	r.POST("/api/v1/session/", s.apiPostSession)
+	r.DELETE("/api/v1/session/", s.apiDeleteSession)
+	r.GET("/api/v1/users/:name/", s.apiGetUser)
+	r.GET("/api/v1/users/:name/posts/", s.apiGetUserPosts)
+	r.GET("/api/v1/inbox/", s.apiGetInbox)
+	r.GET("/api/v1/rooms/", s.apiGetRooms)
+	r.POST("/api/v1/rooms/", s.apiPostRooms)
+	r.GET("/api/v1/rooms/:roomID/", s.apiWithRoom(s.apiGetRoom))
+	r.GET("/api/v1/rooms/:roomID/posts/", s.apiWithRoom(s.apiGetPosts))
+	r.POST("/api/v1/rooms/:roomID/posts/", s.apiWithRoom(s.apiPostPosts))
+	r.GET("/api/v1/rooms/:roomID/posts/:serial/", s.apiWithRoom(s.apiGetPost))
+	r.POST("/api/v1/rooms/:roomID/posts/:serial/reactions/", s.apiWithRoom(s.apiPostReactions))
+}
+
+type apiRoom struct {
+	ID          primitive.ObjectID `json:"id"`
+	Title       string             `json:"title"`
+	Description string             `json:"description"`
+	Author      string             `json:"author"`
+	Created     time.Time          `json:"created"`
+	Updated     time.Time          `json:"updated"`
+	Posts       uint64             `json:"posts"`
+	State       string             `json:"state"`
+}
+
+func newAPIRoom(room *store.Room) *apiRoom {
+	return &apiRoom{
+		ID:          room.ID,
+		Title:       room.Title,
+		Description: room.Description,
+		Author:      room.Author,
+		Created:     room.Created,
+		Updated:     room.Updated,
+		Posts:       room.Serial,
+		State:       room.State.String(),
+	}
+}
+
+type apiPost struct {
+	ID          primitive.ObjectID `json:"id"`
+	RoomID      primitive.ObjectID `json:"room"`
+	Serial      uint64             `json:"serial"`
+	Author      string             `json:"author"`
+	Time        time.Time          `json:"time"`
+	Text        string             `json:"text"`
+	Mentions    []string           `json:"mentions,omitempty"`
+	ReplyTo     uint64             `json:"reply_to,omitempty"`
+	Reactions   []apiReaction      `json:"reactions,omitempty"`
+	Attachments []apiAttachment    `json:"attachments,omitempty"`
+	Edited      *time.Time         `json:"edited,omitempty"`
+	Editor      string             `json:"editor,omitempty"`
+	Deleted     *time.Time         `json:"deleted,omitempty"`
+	Deleter     string             `json:"deleter,omitempty"`
+}
+
+func newAPIPost(post *store.Post) *apiPost {
+	return &apiPost{
+		ID:          post.ID,
+		RoomID:      post.RoomID,
+		Serial:      post.Serial,
+		Author:      post.Author,
+		Time:        post.Time,
+		Text:        post.Text,
+		Mentions:    post.Mentions,
+		ReplyTo:     post.ReplyTo,
+		Reactions:   newAPIReactions(post.Reactions),
+		Attachments: newAPIAttachments(post.Attachments),
+		Edited:      optionalTime(post.Edited),
+		Editor:      post.Editor,
+		Deleted:     optionalTime(post.Deleted),
+		Deleter:     post.Deleter,
+	}
+}
+
+type apiReaction struct {
+	User  string `json:"user"`
+	Emoji string `json:"emoji"`
+}
+
+func newAPIReactions(reactions []store.Reaction) []apiReaction {
+	var result []apiReaction
+	for _, reaction := range reactions {
+		result = append(result, apiReaction{reaction.User, reaction.Emoji})
+	}
+	return result
+}
+
+// apiAttachment has URLs relative to the server root.
+type apiAttachment struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	URL      string `json:"url"`
+	ThumbURL string `json:"thumb_url,omitempty"`
+}
+
+func newAPIAttachments(attachments []store.Attachment) []apiAttachment {
+	var result []apiAttachment
+	for _, att := range attachments {
+		a := apiAttachment{
+			Name: att.Name,
+			Type: att.Type,
+			Size: att.Size,
+			URL:  blobURL(att.Blob, att.Name),
+		}
+		if att.Thumb != "" {
+			a.ThumbURL = blobURL(att.Thumb, att.Name)
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+func newAPIPosts(posts []*store.Post) []*apiPost {
+	result := make([]*apiPost, len(posts))
+	for i, post := range posts {
+		result[i] = newAPIPost(post)
+	}
+	return result
+}
+
+type apiUser struct {
+	Name   string    `json:"name"`
+	Joined time.Time `json:"joined"`
+	Posts  int64     `json:"posts"`
+	Rooms  int64     `json:"rooms"`
+	Role   string    `json:"role"`
+	Ban    *apiBan   `json:"ban,omitempty"`
+}
+
+type apiBan struct {
+	Time   time.Time  `json:"time"`
+	Until  *time.Time `json:"until,omitempty"` // absent if permanent
+	By     string     `json:"by"`
+	Reason string     `json:"reason"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// apiSession is the response to session requests.
+type apiSession struct {
+	Name    string     `json:"name"`
+	Role    string     `json:"role"`
+	Token   string     `json:"token,omitempty"` // only when logging in
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type apiErrorBody struct {
+	Error apiErrorObject `json:"error"`
+}
+
+type apiErrorObject struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiFail responds with an error object.
+func apiFail(w http.ResponseWriter, status int, code, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	writeJSON(w, status, apiErrorBody{apiErrorObject{code, msg}})
+}
+
+// apiError responds with the error object for err, which is a store error,
+// an error from checkActive, or something unexpected.
+func apiError(w http.ResponseWriter, r *http.Request, err error, format string, v ...interface{}) {
+	status, obj := describeError(r, err, format, v...)
+	apiFail(w, status, obj.Code, obj.Message)
+}
+
+// describeError returns the HTTP status and error object for err (see apiError).
+// Unexpected errors are logged.
+func describeError(r *http.Request, err error, format string, v ...interface{}) (int, apiErrorObject) {
+	var closed *store.RoomClosedError
+	var banned *bannedError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, apiErrorObject{"not_found", fmt.Sprintf(format, v...) + ": not found"}
+	case errors.Is(err, store.ErrDuplicate):
+		return http.StatusConflict, apiErrorObject{"duplicate", fmt.Sprintf(format, v...) + ": already exists"}
+	case errors.Is(err, store.ErrBadCredentials):
+		return http.StatusUnauthorized, apiErrorObject{"bad_credentials", "bad user name or password"}
+	case errors.Is(err, store.ErrBadCursor):
+		return http.StatusBadRequest, apiErrorObject{"bad_cursor", "bad cursor"}
+	case errors.Is(err, store.ErrBadReply):
+		return http.StatusUnprocessableEntity, apiErrorObject{"bad_reply", "no such post to reply to"}
+	case errors.As(err, &closed):
+		return http.StatusConflict, apiErrorObject{"room_closed", err.Error()}
+	case errors.Is(err, errNotLoggedIn):
+		return http.StatusUnauthorized, apiErrorObject{"not_logged_in", "not logged in"}
+	case errors.As(err, &banned):
+		return http.StatusForbidden, apiErrorObject{"banned", err.Error()}
+	default:
+		msg := fmt.Sprintf(format, v...)
+		reqLogf(r, "%s: %v", msg, err)
+		return http.StatusInternalServerError, apiErrorObject{"internal", msg}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v) // nothing to do if the client is gone
+}
+
+// hasJSON reports whether r has a JSON body.
+func hasJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// readJSON decodes the body of r into v. If that fails,
+// it responds with an error and returns false.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !hasJSON(r) {
+		apiFail(w, http.StatusUnsupportedMediaType, "bad_request",
+			"request body must be application/json")
+		return false
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		apiFail(w, http.StatusBadRequest, "bad_request",
+			fmt.Sprintf("cannot parse request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) apiWithRoom(
+	next func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room),
+) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		id, err := primitive.ObjectIDFromHex(ps.ByName("roomID"))
+		if err != nil {
+			apiFail(w, http.StatusNotFound, "not_found", "room: not found")
+			return
+		}
+		room, err := s.db.GetRoom(r.Context(), id)
+		if err == nil && room == nil {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			apiError(w, r, err, "room")
+			return
+		}
+		next(w, r, ps, room)
+	}
+}
+
+func (s *Server) apiGetSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, err := s.currentUser(r)
+	if err == nil && user == nil {
+		err = errNotLoggedIn
+	}
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	writeJSON(w, http.StatusOK, apiSession{Name: user.Name, Role: user.Role.String()})
+}
+
+// apiPostSession logs in or signs up. It returns a token for non-browser
+// clients, and also starts a session for browser ones.
+func (s *Server) apiPostSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+		SignUp   bool   `json:"sign_up"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" || req.Password == "" {
+		apiFail(w, http.StatusUnprocessableEntity, "bad_request",
+			"name and password required")
+		return
+	}
+	user := &store.User{Name: req.Name, Password: req.Password}
+	var err error
+	status := http.StatusOK
+	if req.SignUp {
+		reqLogf(r, "sign up %v via API", user.Name)
+		err = s.db.CreateUser(r.Context(), user)
+		status = http.StatusCreated
+	} else {
+		reqLogf(r, "log in %v via API", user.Name)
+		err = s.db.Authenticate(r.Context(), user)
+	}
+	if err != nil {
+		apiError(w, r, err, "user %q", user.Name)
+		return
+	}
+
+	sess := s.session(r)
+	sess.Values["name"] = user.Name
+	if err := sess.Save(r, w); err != nil {
+		apiError(w, r, err, "cannot save session")
+		return
+	}
+	token, err := s.newToken(user.Name)
+	if err != nil {
+		apiError(w, r, err, "cannot make token")
+		return
+	}
+	expires := time.Now().Add(tokenMaxAge).UTC()
+	writeJSON(w, status, apiSession{
+		Name:    user.Name,
+		Role:    user.Role.String(),
+		Token:   token,
+		Expires: &expires,
+	})
+}
+
+// apiDeleteSession logs out of the browser session.
+// Tokens can't be revoked; the client should just forget them.
+func (s *Server) apiDeleteSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sess := s.session(r)
+	delete(sess.Values, "name")
+	if err := sess.Save(r, w); err != nil {
+		apiError(w, r, err, "cannot save session")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) apiGetUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	profile, err := s.db.GetProfile(ctx, ps.ByName("name"))
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	user, err := s.db.GetUser(ctx, profile.Name)
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	resp := &apiUser{
+		Name:   profile.Name,
+		Joined: profile.Joined,
+		Posts:  profile.Posts,
+		Rooms:  profile.Rooms,
+		Role:   user.Role.String(),
+	}
+	if ban := user.Ban; ban != nil {
+		resp.Ban = &apiBan{
+			Time:   ban.Time,
+			Until:  optionalTime(ban.Until),
+			By:     ban.By,
+			Reason: ban.Reason,
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) apiGetUserPosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	const pageSize = 20
+	posts, err := s.db.GetPostsByAuthor(r.Context(), ps.ByName("name"),
+		r.Form.Get("before"), pageSize+1)
+	if err != nil {
+		apiError(w, r, err, "posts")
+		return
+	}
+	var resp struct {
+		Posts []*apiPost `json:"posts"`
+		Next  string     `json:"next,omitempty"` // pass as before= for older posts
+	}
+	if len(posts) > pageSize {
+		posts = posts[:pageSize]
+		resp.Next = store.PostCursor(posts[pageSize-1])
+	}
+	resp.Posts = newAPIPosts(posts)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) apiGetRooms(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	order := store.ByUpdated
+	if sort := r.Form.Get("sort"); sort != "" {
+		var err error
+		order, err = store.ParseRoomOrder(sort)
+		if err != nil {
+			apiFail(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	const pageSize = 50
+	rooms, err := s.db.GetRooms(r.Context(), order, r.Form.Get("after"), pageSize+1)
+	if err != nil {
+		apiError(w, r, err, "rooms")
+		return
+	}
+	var resp struct {
+		Rooms []*apiRoom `json:"rooms"`
+		Next  string     `json:"next,omitempty"` // pass as after= for more rooms
+	}
+	if len(rooms) > pageSize {
+		rooms = rooms[:pageSize]
+		resp.Next = order.Cursor(rooms[pageSize-1])
+	}
+	resp.Rooms = make([]*apiRoom, len(rooms))
+	for i, room := range rooms {
+		resp.Rooms[i] = newAPIRoom(room)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) apiGetInbox(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userName, ok := s.userName(r)
+	if !ok {
+		apiFail(w, http.StatusUnauthorized, "not_logged_in", "not logged in")
+		return
+	}
+	const pageSize = 20
+	posts, err := s.db.GetPostsMentioning(r.Context(), userName,
+		r.Form.Get("before"), pageSize+1)
+	if err != nil {
+		apiError(w, r, err, "posts")
+		return
+	}
+	var resp struct {
+		Posts []*apiPost `json:"posts"`
+		Next  string     `json:"next,omitempty"` // pass as before= for older posts
+	}
+	if len(posts) > pageSize {
+		posts = posts[:pageSize]
+		resp.Next = store.PostCursor(posts[pageSize-1])
+	}
+	resp.Posts = newAPIPosts(posts)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) apiPostRooms(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, err := s.checkActive(r)
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	var req struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Title == "" {
+		apiFail(w, http.StatusUnprocessableEntity, "bad_request", "title required")
+		return
+	}
+	room := &store.Room{
+		Author:      user.Name,
+		Title:       req.Title,
+		Description: req.Description,
+	}
+	if err := s.db.CreateRoom(r.Context(), room); err != nil {
+		apiError(w, r, err, "failed to create room")
+		return
+	}
+	w.Header().Set("Location", "/api/v1/rooms/"+room.ID.Hex()+"/")
+	writeJSON(w, http.StatusCreated, newAPIRoom(room))
+}
+
+func (s *Server) apiGetRoom(
+	w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room,
+) {
+	writeJSON(w, http.StatusOK, newAPIRoom(room))
+}
+
+// apiGetPosts returns a page of posts in room, selected like in getRoom.
+func (s *Server) apiGetPosts(
+	w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room,
+) {
+	before, since, err := parsePage(r, room)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, "bad_request",
+			fmt.Sprintf("bad query string: %v", err))
+		return
+	}
+	posts, err := s.getPage(r.Context(), room, before, since)
+	if err != nil {
+		apiError(w, r, err, "failed to get posts")
+		return
+	}
+	var resp struct {
+		Posts     []*apiPost `json:"posts"`
+		Preceding uint64     `json:"preceding"` // number of older posts
+		Following uint64     `json:"following"` // number of newer posts
+	}
+	resp.Posts = newAPIPosts(posts)
+	if len(posts) > 0 {
+		resp.Preceding = posts[0].Serial - 1
+		resp.Following = room.Serial - posts[len(posts)-1].Serial
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) apiPostPosts(
+	w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room,
+) {
+	user, err := s.checkActive(r)
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	var req struct {
+		Text    string `json:"text"`
+		ReplyTo uint64 `json:"reply_to"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Text == "" {
+		apiFail(w, http.StatusUnprocessableEntity, "bad_request", "text required")
+		return
+	}
+	post := &store.Post{RoomID: room.ID, Author: user.Name, Text: req.Text, ReplyTo: req.ReplyTo}
+	if err := s.db.CreatePost(r.Context(), post); err != nil {
+		apiError(w, r, err, "failed to create post")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/rooms/%s/posts/%d/",
+		room.ID.Hex(), post.Serial))
+	writeJSON(w, http.StatusCreated, newAPIPost(post))
+}
+
+func (s *Server) apiGetPost(
+	w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room,
+) {
+	serial, err := strconv.ParseUint(ps.ByName("serial"), 10, 64)
+	if err != nil {
+		apiFail(w, http.StatusNotFound, "not_found", "post: not found")
+		return
+	}
+	post, err := s.db.GetPost(r.Context(), room, serial)
+	if err != nil {
+		apiError(w, r, err, "post")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIPost(post))
+}
+
+// apiPostReactions toggles the user's reaction with an emoji
+// (one of reactionEmoji) and responds with the post.
+func (s *Server) apiPostReactions(
+	w http.ResponseWriter, r *http.Request, ps httprouter.Params, room *store.Room,
+) {
+	user, err := s.checkActive(r)
+	if err != nil {
+		apiError(w, r, err, "user")
+		return
+	}
+	serial, err := strconv.ParseUint(ps.ByName("serial"), 10, 64)
+	if err != nil {
+		apiFail(w, http.StatusNotFound, "not_found", "post: not found")
+		return
+	}
+	var req struct {
+		Emoji string `json:"emoji"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if !contains(reactionEmoji, req.Emoji) {
+		apiFail(w, http.StatusUnprocessableEntity, "bad_request", "unsupported emoji")
+		return
+	}
+	if room.State != store.RoomOpen {
+		apiError(w, r, &store.RoomClosedError{State: room.State}, "room")
+		return
+	}
+	post, err := s.db.GetPost(r.Context(), room, serial)
+	if err == nil {
+		_, err = s.db.ToggleReaction(r.Context(), post, user.Name, req.Emoji)
+	}
+	if err != nil {
+		apiError(w, r, err, "post")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIPost(post))
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vfaronov/nnbb/store"
+)
+
+func newTestRequest(method, target string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), reqIDKey, "test"))
+}
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{store.ErrNotFound, http.StatusNotFound, "not_found"},
+		{fmt.Errorf("wrapped: %w", store.ErrNotFound), http.StatusNotFound, "not_found"},
+		{store.ErrDuplicate, http.StatusConflict, "duplicate"},
+		{store.ErrBadCredentials, http.StatusUnauthorized, "bad_credentials"},
+		{store.ErrBadCursor, http.StatusBadRequest, "bad_cursor"},
+		{store.ErrBadReply, http.StatusUnprocessableEntity, "bad_reply"},
+		{&store.RoomClosedError{State: store.RoomLocked}, http.StatusConflict, "room_closed"},
+		{fmt.Errorf("wrapped: %w", &store.RoomClosedError{State: store.RoomArchived}),
+			http.StatusConflict, "room_closed"},
+		{errNotLoggedIn, http.StatusUnauthorized, "not_logged_in"},
+		{&bannedError{&store.Ban{Reason: "spam"}}, http.StatusForbidden, "banned"},
+		{errors.New("boom"), http.StatusInternalServerError, "internal"},
+	}
+	r := newTestRequest(http.MethodGet, "/")
+	for _, test := range tests {
+		status, obj := describeError(r, test.err, "failed to %s", "test")
+		if status != test.wantStatus || obj.Code != test.wantCode {
+			t.Errorf("describeError(%v) = %d %q, want %d %q",
+				test.err, status, obj.Code, test.wantStatus, test.wantCode)
+		}
+		if obj.Message == "" {
+			t.Errorf("describeError(%v) has no message", test.err)
+		}
+	}
+
+	// Unexpected errors are not shown to the client.
+	_, obj := describeError(r, errors.New("secret"), "failed to get room")
+	if obj.Message != "failed to get room" {
+		t.Errorf("internal error message is %q", obj.Message)
+	}
+	_, obj = describeError(r, store.ErrNotFound, "room %s", "x")
+	if obj.Message != "room x: not found" {
+		t.Errorf("not found message is %q", obj.Message)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		err            error
+		wantStatus     int
+		wantAuthHeader bool
+	}{
+		{errNotLoggedIn, http.StatusUnauthorized, true},
+		{store.ErrBadCredentials, http.StatusUnauthorized, true},
+		{store.ErrNotFound, http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		apiError(w, newTestRequest(http.MethodGet, "/"), test.err, "user")
+		if w.Code != test.wantStatus {
+			t.Errorf("%v: got status %d, want %d", test.err, w.Code, test.wantStatus)
+		}
+		if got := w.Header().Get("WWW-Authenticate") != ""; got != test.wantAuthHeader {
+			t.Errorf("%v: WWW-Authenticate is %q", test.err, w.Header().Get("WWW-Authenticate"))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%v: Content-Type is %q", test.err, ct)
+		}
+		var body apiErrorBody
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%v: bad body: %v", test.err, err)
+		}
+		if _, want := describeError(newTestRequest(http.MethodGet, "/"), test.err, "user"); body.Error != want {
+			t.Errorf("%v: got %+v, want %+v", test.err, body.Error, want)
+		}
+	}
+}
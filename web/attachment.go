@@ -0,0 +1,329 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for makeThumbnail
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+)
+
+const (
+	maxAttachments           = 4
+	defaultMaxAttachmentSize = 8 << 20
+	maxAttachmentName        = 100 // characters
+	multipartMemory          = 4 << 20
+	// defaultMaxFormSize is the limit on the size of forms without
+	// attachments, the same as ParseForm has for URL-encoded forms.
+	defaultMaxFormSize = 10 << 20
+
+	thumbSize = 240 // pixels, the larger side
+	// Decoding an image takes up to 8 bytes per pixel (for 16-bit PNGs),
+	// so larger images get no thumbnail. DecodeConfig is checked first.
+	maxThumbSource = 12e6 // pixels
+)
+
+// attachmentTypes are the MIME types, as sniffed by http.DetectContentType,
+// of files that can be attached. They are all safe to show in the browser.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// attachmentError is a problem with the uploaded files that is the client's fault.
+type attachmentError struct {
+	status int
+	msg    string
+}
+
+func (e *attachmentError) Error() string { return e.msg }
+
+// maxUploadSize is the limit on the size of a request body
+// that creates a post with attachments.
+func (s *Server) maxUploadSize() int64 {
+	return maxAttachments*s.MaxAttachmentSize + 1<<20
+}
+
+// uploadPath matches the path of postRoom, the only handler
+// that accepts attachments.
+var uploadPath = regexp.MustCompile(`^/rooms/[0-9a-f]{24}/$`)
+
+// maxFormSize returns the limit on the size of the multipart body of r.
+// The form is parsed before routing (see withForm), so the path
+// has to be matched here.
+func (s *Server) maxFormSize(r *http.Request) int64 {
+	if s.Blobs != nil && r.Method == http.MethodPost && uploadPath.MatchString(r.URL.Path) {
+		return s.maxUploadSize()
+	}
+	return defaultMaxFormSize
+}
+
+// saveAttachments stores the files uploaded with r in s.Blobs and returns
+// them as attachments. Thumbnails are made for images that are too large
+// to show in full.
+func (s *Server) saveAttachments(r *http.Request) ([]store.Attachment, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["files"]) == 0 {
+		return nil, nil
+	}
+	files := r.MultipartForm.File["files"]
+	if s.Blobs == nil {
+		return nil, &attachmentError{http.StatusUnprocessableEntity, "attachments are disabled"}
+	}
+	if len(files) > maxAttachments {
+		return nil, &attachmentError{http.StatusUnprocessableEntity,
+			fmt.Sprintf("at most %d files can be attached", maxAttachments)}
+	}
+	var attachments []store.Attachment
+	for _, fh := range files {
+		att, err := s.saveAttachment(r, fh)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, att)
+	}
+	return attachments, nil
+}
+
+func (s *Server) saveAttachment(r *http.Request, fh *multipart.FileHeader) (store.Attachment, error) {
+	att := store.Attachment{Name: attachmentName(fh.Filename), Size: fh.Size}
+	if fh.Size > s.MaxAttachmentSize {
+		return att, &attachmentError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s is larger than %s", att.Name, formatSize(s.MaxAttachmentSize))}
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return att, err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return att, err
+	}
+	// The type claimed by the client is ignored: what matters is
+	// how browsers will see the file when it's served.
+	att.Type = mediaType(http.DetectContentType(data))
+	if !attachmentTypes[att.Type] {
+		return att, &attachmentError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s is of unsupported type %s", att.Name, att.Type)}
+	}
+	if att.Blob, err = s.Blobs.PutBlob(r.Context(), data); err != nil {
+		return att, err
+	}
+	if att.IsImage() {
+		thumb, err := makeThumbnail(data)
+		if err != nil {
+			// The image is still shown, just not as a thumbnail.
+			reqLogf(r, "failed to make thumbnail for %s: %v", att.Blob, err)
+		}
+		if thumb != nil {
+			if att.Thumb, err = s.Blobs.PutBlob(r.Context(), thumb); err != nil {
+				return att, err
+			}
+		}
+	}
+	return att, nil
+}
+
+// discardAttachments deletes the blobs saved by saveAttachments for a post
+// that couldn't be created, unless some other post has them.
+// Failures are only logged.
+// TODO: a concurrent upload of the same file may lose its blob if its post
+// is created between the check and the deletion
+func (s *Server) discardAttachments(r *http.Request, attachments []store.Attachment) {
+	for _, att := range attachments {
+		for _, key := range []string{att.Blob, att.Thumb} {
+			if key == "" {
+				continue
+			}
+			attached, err := s.db.HasAttachment(r.Context(), key)
+			if err == nil && !attached {
+				err = s.Blobs.DeleteBlob(r.Context(), key)
+			}
+			if err != nil {
+				reqLogf(r, "failed to discard blob %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// attachmentName returns the base of a file name sent by the client,
+// shortened for display.
+func attachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	if !utf8.ValidString(name) || name == "." || name == "/" {
+		return "file"
+	}
+	if runes := []rune(name); len(runes) > maxAttachmentName {
+		ext := filepath.Ext(name)
+		if utf8.RuneCountInString(ext) > maxAttachmentName/2 {
+			ext = ""
+		}
+		name = string(runes[:maxAttachmentName-utf8.RuneCountInString(ext)]) + ext
+	}
+	return name
+}
+
+// mediaType returns contentType without parameters.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.TrimSpace(contentType)
+}
+
+// makeThumbnail returns a downscaled copy of the image in data,
+// or nil if it's small enough already or in a format that
+// can't be decoded here (the browser may still be able to show it).
+func makeThumbnail(data []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= thumbSize && config.Height <= thumbSize {
+		return nil, nil
+	}
+	if config.Width*config.Height > maxThumbSource {
+		return nil, fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	w, h := thumbSize, thumbSize
+	if config.Width > config.Height {
+		h = max(1, config.Height*thumbSize/config.Width)
+	} else {
+		w = max(1, config.Width*thumbSize/config.Height)
+	}
+	thumb := scaleDown(src, w, h)
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	return buf.Bytes(), err
+}
+
+// scaleDown returns src scaled down to w by h pixels. Each pixel of the result
+// is the average of up to 4×4 pixels sampled evenly from its box in src,
+// which is good enough for thumbnails and takes bounded time per pixel.
+func scaleDown(src image.Image, w, h int) *image.RGBA64 {
+	dst := image.NewRGBA64(image.Rect(0, 0, w, h))
+	b := src.Bounds()
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var sr, sg, sb, sa, n uint32
+			for sy := y0; sy < y1; sy += max(1, (y1-y0)/4) {
+				for sx := x0; sx < x1; sx += max(1, (x1-x0)/4) {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					sr, sg, sb, sa, n = sr+cr, sg+cg, sb+cb, sa+ca, n+1
+				}
+			}
+			if n > 0 {
+				dst.SetRGBA64(x, y, color.RGBA64{
+					uint16(sr / n), uint16(sg / n), uint16(sb / n), uint16(sa / n),
+				})
+			}
+		}
+	}
+	return dst
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+// blobURL returns the URL of the blob with key, ending with name
+// so that the browser saves it under that name.
+func blobURL(key, name string) string {
+	return "/blobs/" + key + "/" + url.PathEscape(name)
+}
+
+// getBlob serves a blob from s.Blobs, if it's still attached to a post
+// (see store.BlobStore). The name in the URL is ignored.
+// A blob never changes, but it can be taken down by deleting its posts,
+// so caches must revalidate it, which is cheap because the key is the ETag.
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Blobs == nil {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	key := ps.ByName("key")
+	attached, err := s.db.HasAttachment(r.Context(), key)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to check attachment")
+		return
+	}
+	if !attached {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	etag := `"` + key + `"`
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, no-cache")
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := s.Blobs.GetBlob(r.Context(), key)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such file", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get blob")
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if !attachmentTypes[mediaType(contentType)] {
+		contentType = "application/octet-stream"
+	}
+	h.Set("Content-Type", contentType)
+	// Only types that can't run scripts are served as such, but make sure
+	// that browsers don't second-guess them.
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// formatSize returns n bytes in human-readable form.
+func formatSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d B", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+}
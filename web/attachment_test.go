@@ -0,0 +1,188 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vfaronov/nnbb/store"
+)
+
+func TestGetBlob(t *testing.T) {
+	ctx := context.Background()
+	s, db := newTestServer(t)
+	s.Blobs = store.NewMemBlobStore()
+	room := newTestRoom(t, db, 0)
+	key, err := s.Blobs.PutBlob(ctx, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unattached, err := s.Blobs.PutBlob(ctx, []byte("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := &store.Post{
+		RoomID: room.ID, Author: "alice", Text: "file",
+		Attachments: []store.Attachment{{Name: "a.txt", Type: "text/plain", Size: 5, Blob: key}},
+	}
+	if err := db.CreatePost(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(key string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, blobURL(key, "a.txt"), nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get(key, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":           "text/plain; charset=utf-8",
+		"Etag":                   `"` + key + `"`,
+		"Cache-Control":          "public, no-cache",
+		"X-Content-Type-Options": "nosniff",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s is %q, want %q", name, got, want)
+		}
+	}
+	if w := get(key, http.Header{"If-None-Match": {`"` + key + `"`}}); w.Code != http.StatusNotModified {
+		t.Errorf("revalidation got %d, want 304", w.Code)
+	}
+	if w := get(unattached, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unattached blob got %d, want 404", w.Code)
+	}
+	if w := get("../../etc/passwd", nil); w.Code != http.StatusNotFound {
+		t.Errorf("bad key got %d, want 404", w.Code)
+	}
+
+	if err := db.DeletePost(ctx, post, "mod"); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(key, nil); w.Code != http.StatusNotFound {
+		t.Errorf("blob of deleted post got %d, want 404", w.Code)
+	}
+	if w := get(key, http.Header{"If-None-Match": {`"` + key + `"`}}); w.Code != http.StatusNotFound {
+		t.Errorf("revalidation of deleted post got %d, want 404", w.Code)
+	}
+}
+
+func TestDiscardAttachments(t *testing.T) {
+	ctx := context.Background()
+	s, db := newTestServer(t)
+	s.Blobs = store.NewMemBlobStore()
+	room := newTestRoom(t, db, 0)
+	var keys []string
+	for _, data := range []string{"shared", "orphan", "thumb"} {
+		key, err := s.Blobs.PutBlob(ctx, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	shared := store.Attachment{Name: "a.txt", Type: "text/plain", Blob: keys[0]}
+	post := &store.Post{RoomID: room.ID, Author: "alice", Text: "file",
+		Attachments: []store.Attachment{shared}}
+	if err := db.CreatePost(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+
+	s.discardAttachments(newTestRequest(http.MethodPost, "/"), []store.Attachment{
+		shared,
+		{Name: "b.png", Type: "image/png", Blob: keys[1], Thumb: keys[2]},
+	})
+	if _, err := s.Blobs.GetBlob(ctx, keys[0]); err != nil {
+		t.Errorf("blob of another post: %v", err)
+	}
+	for _, key := range keys[1:] {
+		if _, err := s.Blobs.GetBlob(ctx, key); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("discarded blob: got %v, want ErrNotFound", err)
+		}
+	}
+}
+
+func TestMaxFormSize(t *testing.T) {
+	s, _ := newTestServer(t)
+	roomPath := "/rooms/0123456789abcdef01234567/"
+	if got := s.maxFormSize(httptest.NewRequest(http.MethodPost, roomPath, nil)); got != defaultMaxFormSize {
+		t.Errorf("without uploads, got %d", got)
+	}
+	s.Blobs = store.NewMemBlobStore()
+	tests := []struct {
+		method, path string
+		want         int64
+	}{
+		{http.MethodPost, roomPath, s.maxUploadSize()},
+		{http.MethodPost, roomPath + "info/", defaultMaxFormSize},
+		{http.MethodPost, "/rooms/", defaultMaxFormSize},
+		{http.MethodPost, "/signup/", defaultMaxFormSize},
+		{http.MethodGet, roomPath, defaultMaxFormSize},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if got := s.maxFormSize(r); got != test.want {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, got, test.want)
+		}
+	}
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 600, 300))); err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := makeThumbnail(buf.Bytes())
+	if err != nil || thumb == nil {
+		t.Fatalf("got %d bytes, %v", len(thumb), err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != thumbSize || config.Height != thumbSize/2 {
+		t.Errorf("thumbnail is %dx%d", config.Width, config.Height)
+	}
+
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatal(err)
+	}
+	if thumb, err := makeThumbnail(buf.Bytes()); thumb != nil || err != nil {
+		t.Errorf("small image got %d bytes, %v", len(thumb), err)
+	}
+
+	// Only the header of a huge image is read before it's refused.
+	if thumb, err := makeThumbnail(pngHeader(30000, 30000)); thumb != nil || err == nil {
+		t.Errorf("huge image got %d bytes, %v", len(thumb), err)
+	}
+}
+
+// pngHeader returns the start of a PNG image of width by height pixels,
+// which is enough for image.DecodeConfig.
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 6 // RGBA
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(ihdr))
+	return append(data, crc[:]...)
+}
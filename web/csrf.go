@@ -0,0 +1,81 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// Every POST must carry the CSRF token of its session, either in the csrf
+// form field (which templates add to every form) or in the X-CSRF-Token
+// header (which page.html adds to every intercooler request). A cross-site
+// attacker can make the browser send the session cookie, but can't read
+// the token.
+//
+// API requests are exempt if they authenticate with a bearer token, which
+// the browser doesn't send on its own, or if they have a JSON body, which
+// a cross-site page can't send without a CORS preflight (that we don't allow).
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var errorTpl = loadPageTemplate("error.html")
+
+// csrfToken returns the CSRF token for the session of r,
+// creating and saving one if there isn't any yet.
+// It must be called before the response header is written.
+func (s *Server) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	sess := s.session(r)
+	if token, ok := sess.Values[csrfField].(string); ok {
+		return token
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err) // no way to continue securely
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	sess.Values[csrfField] = token
+	if err := sess.Save(r, w); err != nil {
+		reqLogf(r, "failed to save CSRF token: %v", err)
+	}
+	return token
+}
+
+// withCSRF rejects POST requests that don't carry the CSRF token
+// of their session. r.Form must already be parsed (see withForm).
+func (s *Server) withCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && bearerToken(r) == "" && !hasJSON(r) {
+			expected, _ := s.session(r).Values[csrfField].(string)
+			actual := r.Header.Get(csrfHeader)
+			if actual == "" {
+				actual = r.PostForm.Get(csrfField)
+			}
+			if expected == "" ||
+				subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+				reqLogf(r, "rejecting request with bad CSRF token")
+				s.renderError(w, r, http.StatusForbidden,
+					"This form has expired or did not come from this site. "+
+						"Please go back, reload the page, and try again.")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// renderError responds with an error page showing msg.
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if isXHR(r) {
+		http.Error(w, msg, status)
+		return
+	}
+	data := s.pageData(w, r, msg)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := errorTpl.Execute(w, data); err != nil {
+		reqLogf(r, "failed to render HTML: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// csrfTestHandler responds to GET with the CSRF token of the session,
+// and to POST with "ok", behind the same checks as the real handlers.
+func csrfTestHandler(s *Server) http.Handler {
+	return withReqID(s.withForm(s.withCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, s.csrfToken(w, r))
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))))
+}
+
+// getCSRF starts a session with h and returns its cookie and CSRF token.
+func getCSRF(t *testing.T, h http.Handler) (*http.Cookie, string) {
+	t.Helper()
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got cookies %v, want a session cookie", cookies)
+	}
+	return cookies[0], resp.Body.String()
+}
+
+func TestCSRF(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := csrfTestHandler(s)
+	cookie, token := getCSRF(t, h)
+	otherCookie, otherToken := getCSRF(t, h)
+	if token == "" || token == otherToken {
+		t.Fatalf("bad tokens: %q, %q", token, otherToken)
+	}
+	// The token stays the same for the session.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Body.String() != token {
+		t.Errorf("token changed from %q to %q", token, resp.Body.String())
+	}
+
+	form := func(token string) io.Reader {
+		return strings.NewReader(url.Values{"csrf": {token}, "text": {"x"}}.Encode())
+	}
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	_ = mw.WriteField("csrf", token)
+	_ = mw.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		cookie      *http.Cookie
+		contentType string
+		header      map[string]string
+		body        io.Reader
+		want        int
+	}{
+		{"GET is not checked", http.MethodGet, nil, "", nil, nil, http.StatusOK},
+		{"form token", http.MethodPost, cookie, formType, nil, form(token), http.StatusOK},
+		{"header token", http.MethodPost, cookie, formType,
+			map[string]string{csrfHeader: token}, form(""), http.StatusOK},
+		{"multipart token", http.MethodPost, cookie, mw.FormDataContentType(), nil,
+			&multipartBody, http.StatusOK},
+		{"no token", http.MethodPost, cookie, formType, nil, form(""), http.StatusForbidden},
+		{"wrong token", http.MethodPost, cookie, formType, nil, form("x" + token), http.StatusForbidden},
+		{"wrong header token", http.MethodPost, cookie, formType,
+			map[string]string{csrfHeader: "x"}, form(token), http.StatusForbidden},
+		{"token of another session", http.MethodPost, otherCookie, formType, nil,
+			form(token), http.StatusForbidden},
+		{"no session", http.MethodPost, nil, formType, nil, form(token), http.StatusForbidden},
+		{"no session or token", http.MethodPost, nil, formType, nil, form(""), http.StatusForbidden},
+		{"bearer token is exempt", http.MethodPost, cookie, formType,
+			map[string]string{"Authorization": "Bearer xyz"}, form(""), http.StatusOK},
+		{"empty bearer token is not", http.MethodPost, cookie, formType,
+			map[string]string{"Authorization": "Bearer "}, form(""), http.StatusForbidden},
+		{"JSON is exempt", http.MethodPost, cookie, "application/json; charset=utf-8", nil,
+			strings.NewReader(`{}`), http.StatusOK},
+		{"text is not", http.MethodPost, cookie, "text/plain", nil,
+			strings.NewReader(`{}`), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", test.body)
+		if test.cookie != nil {
+			req.AddCookie(test.cookie)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		for key, value := range test.header {
+			req.Header.Set(key, value)
+		}
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		if resp.Code != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.Code, test.want)
+		}
+	}
+}
+
+const formType = "application/x-www-form-urlencoded"
@@ -0,0 +1,265 @@
+package web
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+)
+
+// Atom feeds let feed readers follow a room, the list of rooms, or a user.
+// Their ETag and Last-Modified are derived from Room.Updated and Serial
+// (or from the newest entry), so that polling a feed that hasn't changed
+// is answered with 304 (Not Modified) before fetching any posts.
+// UpdateRoom bumps Room.Updated, so a new title or description is seen.
+// Editing a post doesn't change them, so readers only see edits
+// when something new is posted.
+
+const feedSize = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated time.Time   `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   time.Time    `xml:"updated"`
+	Published time.Time    `xml:"published"`
+	Author    atomPerson   `xml:"author"`
+	Link      atomLink     `xml:"link"`
+	Content   *atomContent `xml:"content,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (s *Server) getRoomFeed(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	etag := fmt.Sprintf(`"%d.%d"`, room.Serial, room.Updated.UnixNano())
+	if notModified(w, r, etag, room.Updated) {
+		return
+	}
+	posts, err := s.db.GetPostsBefore(r.Context(), room, room.Serial+1, feedSize)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get posts")
+		return
+	}
+
+	base := baseURL(r)
+	roomURL := base + "/rooms/" + room.ID.Hex() + "/"
+	feed := atomFeed{
+		ID:      roomURL,
+		Title:   room.Title,
+		Updated: room.Updated,
+		Author:  newAtomPerson(base, room.Author),
+		Links:   feedLinks(r, roomURL),
+	}
+	// Newest first.
+	for i := len(posts) - 1; i >= 0; i-- {
+		if entry, ok := postEntry(base, room, posts[i]); ok {
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+	writeAtom(w, r, &feed)
+}
+
+func (s *Server) getRoomsFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rooms, err := s.db.GetRooms(r.Context(), store.ByUpdated, "", feedSize)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get rooms")
+		return
+	}
+	// An empty feed has nothing to derive validators from, so it's not
+	// cacheable, and it's as new as the response.
+	updated := time.Now()
+	if len(rooms) > 0 {
+		updated = rooms[0].Updated
+		etag := fmt.Sprintf(`"%s.%d.%d"`, rooms[0].ID.Hex(), rooms[0].Serial, updated.UnixNano())
+		if notModified(w, r, etag, updated) {
+			return
+		}
+	}
+
+	base := baseURL(r)
+	feed := atomFeed{
+		ID:      base + "/rooms/",
+		Title:   "nnBB rooms",
+		Updated: updated,
+		Links:   feedLinks(r, base+"/rooms/"),
+	}
+	for _, room := range rooms {
+		roomURL := base + "/rooms/" + room.ID.Hex() + "/"
+		entry := atomEntry{
+			ID:        roomURL,
+			Title:     room.Title,
+			Updated:   room.Updated,
+			Published: room.Created,
+			Author:    *newAtomPerson(base, room.Author),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: roomURL},
+		}
+		if room.Description != "" {
+			html, err := markdown(room.Description, nil)
+			if err != nil {
+				reqLogf(r, "failed to render description of %v: %v", room.ID, err)
+			}
+			entry.Content = &atomContent{Type: "html", Body: string(html)}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	writeAtom(w, r, &feed)
+}
+
+func (s *Server) getUserFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	profile, err := s.db.GetProfile(ctx, ps.ByName("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get profile")
+		return
+	}
+	posts, err := s.db.GetPostsByAuthor(ctx, profile.Name, "", feedSize)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get posts")
+		return
+	}
+	updated := profile.Joined
+	if len(posts) > 0 {
+		updated = posts[0].Time
+		etag := fmt.Sprintf(`"%s.%d"`, posts[0].RoomID.Hex(), posts[0].Serial)
+		if notModified(w, r, etag, updated) {
+			return
+		}
+	}
+	rooms, err := s.getRoomsOf(r, posts)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get rooms")
+		return
+	}
+
+	base := baseURL(r)
+	author := newAtomPerson(base, profile.Name)
+	feed := atomFeed{
+		ID:      author.URI,
+		Title:   "Posts by " + profile.Name,
+		Updated: updated,
+		Author:  author,
+		Links:   feedLinks(r, author.URI),
+	}
+	for _, post := range posts {
+		if entry, ok := postEntry(base, rooms[post.RoomID], post); ok {
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+	writeAtom(w, r, &feed)
+}
+
+// postEntry returns the feed entry for post in room,
+// or false if there's nothing to show because post is deleted.
+func postEntry(base string, room *store.Room, post *store.Post) (atomEntry, bool) {
+	if !post.Deleted.IsZero() {
+		return atomEntry{}, false
+	}
+	postURL := fmt.Sprintf("%s/rooms/%s/posts/%d/", base, room.ID.Hex(), post.Serial)
+	updated := post.Time
+	if !post.Edited.IsZero() {
+		updated = post.Edited
+	}
+	// The HTML is escaped by encoding/xml, as Atom wants for type="html".
+	// An error from markdown leaves the HTML empty, which is fine for a feed.
+	html, _ := markdown(post.Text, post)
+	return atomEntry{
+		ID:        postURL,
+		Title:     fmt.Sprintf("%s #%d", room.Title, post.Serial),
+		Updated:   updated,
+		Published: post.Time,
+		Author:    *newAtomPerson(base, post.Author),
+		Link:      atomLink{Rel: "alternate", Type: "text/html", Href: postURL},
+		Content:   &atomContent{Type: "html", Body: string(html)},
+	}, true
+}
+
+func newAtomPerson(base, name string) *atomPerson {
+	return &atomPerson{Name: name, URI: base + userURL(name)}
+}
+
+// feedLinks returns the links from a feed served at r to itself and to htmlURL.
+func feedLinks(r *http.Request, htmlURL string) []atomLink {
+	return []atomLink{
+		{Rel: "self", Type: "application/atom+xml", Href: baseURL(r) + r.URL.Path},
+		{Rel: "alternate", Type: "text/html", Href: htmlURL},
+	}
+}
+
+// baseURL returns the scheme and host of the server as seen by r.
+// Feeds need absolute URLs, because they are read out of context.
+// TODO: respect X-Forwarded-Proto behind a reverse proxy
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// notModified sets the ETag and Last-Modified headers for the response to r.
+// If r is conditional and they show that the client's copy is fresh,
+// notModified responds with 304 (Not Modified) and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	fresh := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored when there's If-None-Match (RFC 7232).
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				fresh = true
+			}
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		fresh = !modified.Truncate(time.Second).After(since)
+	}
+	if fresh {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return fresh
+}
+
+func writeAtom(w http.ResponseWriter, r *http.Request, feed *atomFeed) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		reqLogf(r, "failed to write feed: %v", err)
+	}
+}
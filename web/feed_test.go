@@ -0,0 +1,55 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomFeedValidators(t *testing.T) {
+	s, db := newTestServer(t)
+	room := newTestRoom(t, db, 3)
+	for _, path := range []string{"/rooms/" + room.ID.Hex() + "/feed/", "/feed/"} {
+		resp := httptest.NewRecorder()
+		s.Handler.ServeHTTP(resp, newTestRequest(http.MethodGet, path))
+		etag := resp.Header().Get("ETag")
+		if resp.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: got %d with ETag %q", path, resp.Code, etag)
+		}
+
+		req := newTestRequest(http.MethodGet, path)
+		req.Header.Set("If-None-Match", etag)
+		resp = httptest.NewRecorder()
+		s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusNotModified {
+			t.Errorf("%s: unchanged, got %d, want 304", path, resp.Code)
+		}
+
+		room.Title += " renamed"
+		if err := db.UpdateRoom(context.Background(), room); err != nil {
+			t.Fatal(err)
+		}
+		resp = httptest.NewRecorder()
+		s.Handler.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), room.Title) {
+			t.Errorf("%s: after UpdateRoom, got %d, want 200 with the new title", path, resp.Code)
+		}
+	}
+}
+
+func TestRoomsFeedEmpty(t *testing.T) {
+	s, _ := newTestServer(t)
+	resp := httptest.NewRecorder()
+	s.Handler.ServeHTTP(resp, newTestRequest(http.MethodGet, "/feed/"))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", resp.Code)
+	}
+	if lm := resp.Header().Get("Last-Modified"); lm != "" {
+		t.Errorf("got Last-Modified %q for an empty feed", lm)
+	}
+	if strings.Contains(resp.Body.String(), "<updated>0001-") {
+		t.Errorf("empty feed has a zero updated time:\n%s", resp.Body)
+	}
+}
@@ -1,20 +1,137 @@
 package web
 
 import (
-	"bytes"
+	"fmt"
 	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
 
-	"github.com/yuin/goldmark"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// postView is what the "post" template renders: a post as seen by User
+// (who may be empty) with Role, with the CSRF token for its forms.
+type postView struct {
+	*store.Post
+	User string
+	Role store.Role
+	CSRF string
+}
+
 var funcMap = template.FuncMap{
 	"addUint64": func(x, y uint64) uint64 { return x + y },
-	"markdown": func(src string) (template.HTML, error) {
-		var buf bytes.Buffer
-		// TODO: does goldmark.Convert return error due to the source (not just the io.Writer)?
-		// if it does, need to sanitize
-		err := goldmark.Convert([]byte(src), &buf)
-		html := template.HTML(buf.String()) //nolint:gosec
-		return html, err
+	"postView": func(post *store.Post, data pageData) postView {
+		return postView{post, data.User, data.Role, data.CSRF}
+	},
+	"highlight": highlight,
+	"truncate":  truncate,
+	"userURL":   userURL,
+	// The optional argument is the post whose text is rendered.
+	"markdown": func(src string, post ...*store.Post) (template.HTML, error) {
+		if len(post) > 0 {
+			return markdown(src, post[0])
+		}
+		return markdown(src, nil)
 	},
+	"postURL": postURL,
+	"quote":   quote,
+	"reactionCounts": func(view postView) []reactionCount {
+		return countReactions(view.Post, view.User)
+	},
+	"reactionEmoji": func() []string { return reactionEmoji },
+	"blobURL":       blobURL,
+	"formatSize":    formatSize,
+}
+
+func userURL(name string) string {
+	return "/users/" + url.PathEscape(name) + "/"
+}
+
+// postURL returns the permalink of post serial in roomID:
+// the room page around the post, scrolled to it.
+func postURL(roomID primitive.ObjectID, serial uint64) string {
+	return fmt.Sprintf("/rooms/%s/?before=%d#post%d", roomID.Hex(), serial+10, serial)
+}
+
+// quote returns text as a Markdown blockquote, for starting a reply.
+func quote(text string) string {
+	if text == "" {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(text, "\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight("> "+line, " \r")
+	}
+	return strings.Join(lines, "\n") + "\n\n"
+}
+
+// snippetLen is the approximate maximum length of text rendered by highlight.
+const snippetLen = 300
+
+// highlight returns text as HTML with all words of query wrapped in <mark>.
+// If text is long, it is cut down to a snippet around the first match.
+func highlight(text, query string) template.HTML {
+	var words []string
+	for _, word := range strings.Fields(query) {
+		words = append(words, regexp.QuoteMeta(word))
+	}
+	var matches [][]int
+	if len(words) > 0 {
+		exp := regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+		matches = exp.FindAllStringIndex(text, -1)
+	}
+
+	start, end := 0, len(text)
+	if end > snippetLen {
+		if len(matches) > 0 && matches[0][0] > snippetLen/3 {
+			start = matches[0][0] - snippetLen/3
+		}
+		if end > start+snippetLen {
+			end = start + snippetLen
+		}
+		// Don't cut in the middle of a UTF-8 sequence.
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+
+	var buf strings.Builder
+	if start > 0 {
+		buf.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m[0] < pos || m[1] > end {
+			continue
+		}
+		buf.WriteString(template.HTMLEscapeString(text[pos:m[0]]))
+		buf.WriteString("<mark>")
+		buf.WriteString(template.HTMLEscapeString(text[m[0]:m[1]]))
+		buf.WriteString("</mark>")
+		pos = m[1]
+	}
+	buf.WriteString(template.HTMLEscapeString(text[pos:end]))
+	if end < len(text) {
+		buf.WriteString("…")
+	}
+	return template.HTML(buf.String()) //nolint:gosec
+}
+
+// truncate returns text cut down to at most n runes, with an ellipsis
+// if anything was cut.
+func truncate(text string, n int) string {
+	i := 0
+	for pos := range text {
+		if i == n {
+			return text[:pos] + "…"
+		}
+		i++
+	}
+	return text
 }
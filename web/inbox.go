@@ -0,0 +1,170 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+)
+
+var inboxTpl = loadPageTemplate("inbox.html")
+
+// inboxCatchUp is how many recent mentions are checked after a Resync.
+const inboxCatchUp = 20
+
+type inboxPayload struct {
+	Mentions []mention
+	Next     string // cursor for older posts, if any
+}
+
+// mention is what the "mention" template renders.
+type mention struct {
+	Room *store.Room
+	Post *store.Post
+}
+
+// getInbox lists posts that mention the user, newest first.
+func (s *Server) getInbox(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Redirect(w, r, "/signup/?redir=/inbox/", http.StatusSeeOther)
+		return
+	}
+
+	// Get one extra post to see if there are older ones.
+	const pageSize = 20
+	posts, err := s.db.GetPostsMentioning(r.Context(), userName, r.Form.Get("before"), pageSize+1)
+	if errors.Is(err, store.ErrBadCursor) {
+		http.Error(w, "bad query string: bad cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get posts")
+		return
+	}
+	var payload inboxPayload
+	if len(posts) > pageSize {
+		posts = posts[:pageSize]
+		payload.Next = store.PostCursor(posts[pageSize-1])
+	}
+	rooms, err := s.getRoomsOf(r, posts)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get rooms")
+		return
+	}
+	for _, post := range posts {
+		payload.Mentions = append(payload.Mentions, mention{rooms[post.RoomID], post})
+	}
+
+	if isXHR(r) {
+		s.renderFragment(w, r, inboxTpl, "mentions", payload)
+	} else {
+		s.renderPage(w, r, inboxTpl, payload)
+	}
+}
+
+// getInboxUpdates streams new posts that mention the user.
+// Each is sent as a "mention" fragment, or as a "mention" event
+// with the JSON post if the client wants JSON (see wantsJSON).
+// After a Resync, the mentions that may have been dropped
+// are fetched from the DB.
+func (s *Server) getInboxUpdates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	f, ok := w.(http.Flusher)
+	if !ok {
+		reqLogf(r, "cannot stream events to %T", w)
+		http.Error(w, "cannot stream events", http.StatusNotImplemented)
+		return
+	}
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusForbidden)
+		return
+	}
+	asJSON := wantsJSON(r)
+	// since is the time of the newest mention sent, for catching up
+	// after a Resync. Mentions from before the stream was opened
+	// are already on the page.
+	since := time.Now()
+	send := func(post *store.Post) error {
+		since = post.Time
+		if asJSON {
+			return sendJSON(w, "mention", newAPIPost(post))
+		}
+		room, err := s.db.GetRoom(ctx, post.RoomID)
+		if err != nil {
+			return err
+		}
+		if room == nil {
+			return errors.New("room of post not found")
+		}
+		return sendMention(w, room, post)
+	}
+
+	events := s.db.StreamMentions(userName, s.Backpressure)
+	defer s.db.CancelStream(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	f.Flush()
+
+	reqLogf(r, "start streaming mentions of %s", userName)
+
+	var err error
+loop:
+	for {
+		var ev store.Event
+		var ok bool
+		select {
+		case <-ctx.Done(): // client closed connection
+			err = ctx.Err()
+			break loop
+		case ev, ok = <-events:
+		}
+		if !ok {
+			err = errors.New("DB abandoned listener")
+			break loop
+		}
+		switch ev.Type {
+		case store.PostCreated:
+			err = send(ev.Post)
+
+		case store.Resync:
+			// We can't tell how many mentions we have missed,
+			// but it's unlikely to be more than a page.
+			reqLogf(r, "resync after %v", since)
+			var posts []*store.Post
+			posts, err = s.db.GetPostsMentioning(ctx, userName, "", inboxCatchUp)
+			for i := len(posts) - 1; i >= 0 && err == nil; i-- {
+				if posts[i].Time.After(since) {
+					err = send(posts[i])
+				}
+			}
+
+		default:
+			continue loop
+		}
+		if err != nil {
+			break loop
+		}
+		f.Flush()
+	}
+	reqLogf(r, "stop streaming mentions: %v", err)
+}
+
+// sendMention writes an HTML fragment about post in room
+// in a text/event-stream message.
+func sendMention(w http.ResponseWriter, room *store.Room, post *store.Post) error {
+	_, err := w.Write([]byte("data: "))
+	if err != nil {
+		return err
+	}
+	err = inboxTpl.ExecuteTemplate(dataWriter{w}, "mention", mention{room, post})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{'\n', '\n'})
+	return err
+}
@@ -0,0 +1,438 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vfaronov/nnbb/store"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// MarkdownFeatures is a set of optional Markdown extensions
+// (beyond CommonMark) and link handling.
+type MarkdownFeatures uint
+
+const (
+	// MarkdownTables enables GitHub-style tables.
+	MarkdownTables MarkdownFeatures = 1 << iota
+	// MarkdownStrikethrough enables ~~strikethrough~~.
+	MarkdownStrikethrough
+	// MarkdownAutolinks turns bare URLs like www.example.com into links.
+	MarkdownAutolinks
+	// MarkdownTaskLists renders list items like "[x] done" as checkboxes.
+	MarkdownTaskLists
+	// MarkdownNewTab makes external links open in a new tab.
+	MarkdownNewTab
+)
+
+var markdownFeatureNames = []string{"tables", "strikethrough", "autolinks", "tasklists", "newtab"}
+
+// DefaultMarkdownFeatures are the features used unless SetMarkdownFeatures
+// is called.
+const DefaultMarkdownFeatures = MarkdownTables | MarkdownStrikethrough |
+	MarkdownAutolinks | MarkdownTaskLists
+
+func (features MarkdownFeatures) String() string {
+	var names []string
+	for i, name := range markdownFeatureNames {
+		if features&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseMarkdownFeatures returns the MarkdownFeatures whose String is s.
+func ParseMarkdownFeatures(s string) (MarkdownFeatures, error) {
+	var features MarkdownFeatures
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, known := range markdownFeatureNames {
+			if name == known {
+				features |= 1 << i
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("web: unknown Markdown feature: %q", name)
+		}
+	}
+	return features, nil
+}
+
+var md = newMarkdown(DefaultMarkdownFeatures)
+
+// SetMarkdownFeatures changes how posts and room descriptions are rendered
+// by all servers. It must be called before any server is started.
+func SetMarkdownFeatures(features MarkdownFeatures) {
+	md = newMarkdown(features)
+}
+
+func newMarkdown(features MarkdownFeatures) goldmark.Markdown {
+	var exts []goldmark.Extender
+	if features&MarkdownTables != 0 {
+		// The align attribute is easier to sanitize than style.
+		exts = append(exts, extension.NewTable(
+			extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)))
+	}
+	if features&MarkdownStrikethrough != 0 {
+		exts = append(exts, extension.Strikethrough)
+	}
+	if features&MarkdownAutolinks != 0 {
+		exts = append(exts, extension.Linkify)
+	}
+	if features&MarkdownTaskLists != 0 {
+		exts = append(exts, extension.TaskList)
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(
+			parser.WithBlockParsers(
+				// Before goldmark's blockquote parser (800).
+				util.Prioritized(replyLineParser{parser.NewParagraphParser()}, 790),
+			),
+			parser.WithInlineParsers(
+				util.Prioritized(mentionParser{}, 500),
+				util.Prioritized(replyParser{}, 500),
+			),
+		),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(
+			// Lower values take precedence over goldmark's HTML renderer (1000).
+			util.Prioritized(&safeRenderer{newTab: features&MarkdownNewTab != 0}, 100),
+		)),
+	)
+}
+
+// markdown renders src (the text of a post or room description) to HTML.
+// If src is (a revision of) post, it gets links for @mentions of users
+// in post.Mentions and for >>N references to earlier posts in the room.
+// The Markdown renderer drops raw HTML and unsafe URLs, and its output
+// is then passed through sanitizeHTML, in case an extension (or a bug)
+// lets something else through.
+func markdown(src string, post *store.Post) (template.HTML, error) {
+	pc := parser.NewContext()
+	pc.Set(postKey, post)
+	var buf bytes.Buffer
+	if err := md.Convert([]byte(src), &buf, parser.WithContext(pc)); err != nil {
+		return "", err
+	}
+	return template.HTML(sanitizeHTML(buf.String())), nil //nolint:gosec
+}
+
+// postKey is for the *store.Post being rendered (nil if none)
+// in the parser context.
+var postKey = parser.NewContextKey()
+
+// mentionParser turns @name into a link to the profile of name,
+// if name is among the mentions of the post.
+type mentionParser struct{}
+
+func (mentionParser) Trigger() []byte {
+	return []byte{'@'}
+}
+
+func (mentionParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	post, _ := pc.Get(postKey).(*store.Post)
+	if post == nil {
+		return nil
+	}
+	line, segment := block.PeekLine()
+	name := store.MentionAt(string(line), block.PrecendingCharacter())
+	if name == "" || !contains(post.Mentions, name) {
+		return nil
+	}
+	n := 1 + len(name) // with the @
+	block.Advance(n)
+	link := ast.NewLink()
+	link.Destination = []byte(userURL(name))
+	link.AppendChild(link, ast.NewTextSegment(text.NewSegment(segment.Start, segment.Start+n)))
+	return link
+}
+
+// replyRef matches a >>N reference to post N at the start of the input.
+var replyRef = regexp.MustCompile(`^>>([0-9]+)\b`)
+
+// replyParser turns >>N into a link to post N in the same room,
+// if it's earlier than the post being rendered.
+type replyParser struct{}
+
+func (replyParser) Trigger() []byte {
+	return []byte{'>'}
+}
+
+func (replyParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	post, _ := pc.Get(postKey).(*store.Post)
+	if post == nil {
+		return nil
+	}
+	line, segment := block.PeekLine()
+	m := replyRef.FindSubmatch(line)
+	if m == nil {
+		return nil
+	}
+	serial, err := strconv.ParseUint(string(m[1]), 10, 64)
+	if err != nil || serial == 0 || serial >= post.Serial {
+		return nil
+	}
+	block.Advance(len(m[0]))
+	link := ast.NewLink()
+	link.Destination = []byte(postURL(post.RoomID, serial))
+	link.AppendChild(link, ast.NewTextSegment(text.NewSegment(segment.Start, segment.Start+len(m[0]))))
+	return link
+}
+
+// replyLineParser starts a paragraph at a line beginning with >>N,
+// which would otherwise be parsed as a nested blockquote.
+type replyLineParser struct {
+	parser.BlockParser // for paragraphs
+}
+
+func (replyLineParser) Trigger() []byte {
+	return []byte{'>'}
+}
+
+func (p replyLineParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, _ := reader.PeekLine()
+	_, pos := util.IndentWidth(line, reader.LineOffset())
+	if !replyRef.Match(line[pos:]) {
+		return nil, parser.NoChildren
+	}
+	return p.BlockParser.Open(parent, reader, pc)
+}
+
+func (replyLineParser) CanInterruptParagraph() bool {
+	// Otherwise the blockquote parser would interrupt it.
+	return true
+}
+
+// safeRenderer overrides goldmark's rendering of raw HTML and links.
+type safeRenderer struct {
+	newTab bool
+}
+
+func (r *safeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindRawHTML, r.renderNothing)
+	reg.Register(ast.KindHTMLBlock, r.renderNothing)
+	reg.Register(ast.KindLink, r.renderLink)
+	reg.Register(ast.KindAutoLink, r.renderAutoLink)
+	reg.Register(ast.KindImage, r.renderImage)
+}
+
+func (r *safeRenderer) renderNothing(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *safeRenderer) renderLink(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	n := node.(*ast.Link)
+	if !entering {
+		_, _ = w.WriteString("</a>")
+		return ast.WalkContinue, nil
+	}
+	r.openLink(w, n.Destination, n.Title)
+	return ast.WalkContinue, nil
+}
+
+func (r *safeRenderer) renderAutoLink(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	n := node.(*ast.AutoLink)
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	url := n.URL(source)
+	if n.AutoLinkType == ast.AutoLinkEmail && !bytes.HasPrefix(bytes.ToLower(url), []byte("mailto:")) {
+		url = append([]byte("mailto:"), url...)
+	}
+	r.openLink(w, url, nil)
+	_, _ = w.Write(util.EscapeHTML(n.Label(source)))
+	_, _ = w.WriteString("</a>")
+	return ast.WalkContinue, nil
+}
+
+// openLink writes the <a> start tag for a link to dest,
+// which is left out if it's not safe.
+func (r *safeRenderer) openLink(w util.BufWriter, dest, title []byte) {
+	_, _ = w.WriteString("<a")
+	// URLEscape also resolves character references,
+	// so only the escaped URL can be checked.
+	url := util.URLEscape(dest, true)
+	if isSafeURL(url, linkSchemes) {
+		_, _ = w.WriteString(` href="`)
+		_, _ = w.Write(util.EscapeHTML(url))
+		_ = w.WriteByte('"')
+		if isExternalURL(url) {
+			if r.newTab {
+				_, _ = w.WriteString(` rel="nofollow ugc noopener" target="_blank"`)
+			} else {
+				_, _ = w.WriteString(` rel="nofollow ugc"`)
+			}
+		}
+	}
+	if title != nil {
+		_, _ = w.WriteString(` title="`)
+		gmhtml.DefaultWriter.Write(w, title)
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('>')
+}
+
+func (r *safeRenderer) renderImage(
+	w util.BufWriter, source []byte, node ast.Node, entering bool,
+) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.Image)
+	_, _ = w.WriteString(`<img src="`)
+	if url := util.URLEscape(n.Destination, true); isSafeURL(url, imageSchemes) {
+		_, _ = w.Write(util.EscapeHTML(url))
+	}
+	_, _ = w.WriteString(`" alt="`)
+	_, _ = w.Write(util.EscapeHTML(n.Text(source)))
+	_ = w.WriteByte('"')
+	if n.Title != nil {
+		_, _ = w.WriteString(` title="`)
+		gmhtml.DefaultWriter.Write(w, n.Title)
+		_ = w.WriteByte('"')
+	}
+	_ = w.WriteByte('>')
+	return ast.WalkSkipChildren, nil
+}
+
+// URL schemes allowed in links and images. URLs without a scheme
+// (relative to the page) are always allowed.
+var (
+	linkSchemes  = map[string]bool{"http": true, "https": true, "mailto": true}
+	imageSchemes = map[string]bool{"http": true, "https": true}
+)
+
+// isSafeURL reports whether url is relative or has one of schemes.
+// Browsers ignore case, tabs and newlines in schemes, and leading
+// spaces and control characters, so isSafeURL does too.
+func isSafeURL(url []byte, schemes map[string]bool) bool {
+	s := strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, string(url))
+	s = strings.TrimLeftFunc(s, func(r rune) bool { return r <= ' ' })
+	i := strings.IndexAny(s, ":/?#")
+	if i < 0 || s[i] != ':' {
+		return true
+	}
+	return schemes[strings.ToLower(s[:i])]
+}
+
+// isExternalURL reports whether url (which isSafeURL) leads to another site.
+func isExternalURL(url []byte) bool {
+	return bytes.Contains(url, []byte(":")) || bytes.HasPrefix(url, []byte("//"))
+}
+
+// sanitizedAttrs are the elements allowed by sanitizeHTML
+// and the attributes allowed on each of them.
+var sanitizedAttrs = map[atom.Atom][]string{
+	atom.P: nil, atom.Br: nil, atom.Hr: nil,
+	atom.H1: nil, atom.H2: nil, atom.H3: nil, atom.H4: nil, atom.H5: nil, atom.H6: nil,
+	atom.Em: nil, atom.Strong: nil, atom.Del: nil, atom.Blockquote: nil,
+	atom.Code: {"class"}, atom.Pre: nil,
+	atom.Ul: nil, atom.Ol: {"start"}, atom.Li: nil,
+	atom.A:     {"href", "title", "rel", "target"},
+	atom.Img:   {"src", "alt", "title"},
+	atom.Table: nil, atom.Thead: nil, atom.Tbody: nil, atom.Tr: nil,
+	atom.Th: {"align"}, atom.Td: {"align"},
+	atom.Input: {"type", "checked", "disabled"},
+}
+
+// sanitizeHTML returns src with all elements and attributes removed
+// except those in sanitizedAttrs, and with unsafe URLs removed.
+// The text is kept, except for comments.
+func sanitizeHTML(src string) string {
+	var buf strings.Builder
+	z := html.NewTokenizer(strings.NewReader(src))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// The only possible error is io.EOF, as we're reading a string.
+			return buf.String()
+		case html.TextToken:
+			buf.WriteString(html.EscapeString(string(z.Text())))
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := z.Token()
+			allowed, ok := sanitizedAttrs[tok.DataAtom]
+			if !ok {
+				continue
+			}
+			if tok.DataAtom == atom.Input && !isCheckbox(tok) {
+				continue
+			}
+			tok.Attr = sanitizeAttrs(tok, allowed)
+			buf.WriteString(tok.String())
+		}
+	}
+}
+
+func sanitizeAttrs(tok html.Token, allowed []string) []html.Attribute {
+	var attrs []html.Attribute
+	for _, attr := range tok.Attr {
+		if attr.Namespace != "" || !contains(allowed, attr.Key) {
+			continue
+		}
+		switch attr.Key {
+		case "href":
+			if !isSafeURL([]byte(attr.Val), linkSchemes) {
+				continue
+			}
+		case "src":
+			if !isSafeURL([]byte(attr.Val), imageSchemes) {
+				continue
+			}
+		case "class":
+			// Only for fenced code blocks.
+			if !strings.HasPrefix(attr.Val, "language-") || strings.ContainsAny(attr.Val, " \t\n") {
+				continue
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+func isCheckbox(tok html.Token) bool {
+	for _, attr := range tok.Attr {
+		if attr.Key == "type" {
+			return attr.Val == "checkbox"
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
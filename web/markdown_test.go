@@ -0,0 +1,208 @@
+package web
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/net/html"
+)
+
+// hostileMarkdown is a corpus of inputs that try to get scripts
+// or other unsafe HTML past markdown.
+var hostileMarkdown = []string{
+	// Link and image schemes.
+	`[x](javascript:alert(1))`,
+	`[x](JavaScript:alert(1))`,
+	`[x](  javascript:alert(1))`,
+	`[x](<java	script:alert(1)>)`,
+	"[x](<java\nscript:alert(1)>)",
+	`[x](&#106;avascript:alert(1))`,
+	`[x](&#x6A;&#x61;&#x76;&#x61;&#x73;&#x63;&#x72;&#x69;&#x70;&#x74;:alert(1))`,
+	`[x](javascript&colon;alert(1))`,
+	`[x](jav&#x09;ascript:alert(1))`,
+	`[x](&#0;javascript:alert(1))`,
+	`[x](%6Aavascript:alert(1))`,
+	`[x](vbscript:msgbox(1))`,
+	`[x](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)`,
+	`[x](DATA:text/html,<script>alert(1)</script>)`,
+	`![x](javascript:alert(1))`,
+	`![x](data:image/svg+xml,<svg onload=alert(1)>)`,
+	`![x](&#100;ata:image/png;base64,AAAA)`,
+	"[x][ref]\n\n[ref]: javascript:alert(1)",
+	"![x][ref]\n\n[ref]: data:text/html,hi",
+	`<javascript:alert(1)>`,
+	`<data:text/html,<script>alert(1)</script>>`,
+	`<JAVASCRIPT:alert(1)>`,
+
+	// Raw HTML.
+	`<script>alert(1)</script>`,
+	"<script>\nalert(1)\n</script>",
+	`<iframe src="javascript:alert(1)"></iframe>`,
+	"<div onclick=alert(1)>\n\nx\n\n</div>",
+	`text <img src=x onerror=alert(1)> text`,
+	`text <a href="javascript:alert(1)">x</a>`,
+	`text <svg><script>alert(1)</script></svg>`,
+	`<style>body{display:none}</style>`,
+	`<!-- <script>alert(1)</script> -->`,
+	`<object data="x.swf"></object><embed src="x.swf">`,
+	`<form action="javascript:alert(1)"><button>x</button></form>`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<scr<script>ipt>alert(1)</script>`,
+	"<![CDATA[<script>alert(1)</script>]]>",
+	`<p title="x" onmouseover="alert(1)">x</p>`,
+
+	// Attribute injection through titles.
+	`[x](/ "a\" onmouseover=\"alert(1)")`,
+	`[x](/ 'a" onmouseover="alert(1)')`,
+	`[x](/ (a" onmouseover="alert(1)))`,
+	`![x](/a.png "a\" onerror=\"alert(1)")`,
+	`![x" onerror="alert(1)](/a.png)`,
+	"[x][ref]\n\n[ref]: / \"a\\\" onclick=\\\"alert(1)\"",
+	`[x](/ "&quot; onmouseover=&quot;alert(1)")`,
+
+	// Autolinks.
+	`www.example.com/"onmouseover="alert(1)`,
+	`https://example.com/<script>alert(1)</script>`,
+	`javascript:alert(1)`,
+	`<mailto:a@example.com?body=<script>alert(1)</script>>`,
+	`a@example.com"onmouseover="alert(1)`,
+
+	// Task lists and tables.
+	"- [x] <script>alert(1)</script>",
+	"- [ ] [x](javascript:alert(1))",
+	"| a | b |\n|---|:-:|\n| <script>alert(1)</script> | [x](javascript:alert(1)) |",
+	"| a |\n|---|\n| <img src=x onerror=alert(1)> |",
+	"| a\" onclick=\"alert(1) |\n|---|\n| b |",
+
+	// Code keeps its text, but not its tags.
+	"```\" onclick=\"alert(1)\n<script>alert(1)</script>\n```",
+	"```js onclick=alert(1)\nx\n```",
+	"`<script>alert(1)</script>`",
+}
+
+func TestMarkdownHostile(t *testing.T) {
+	defer SetMarkdownFeatures(DefaultMarkdownFeatures)
+	post := &store.Post{RoomID: primitive.NewObjectID(), Serial: 10}
+	for _, features := range []MarkdownFeatures{
+		DefaultMarkdownFeatures,
+		DefaultMarkdownFeatures | MarkdownNewTab,
+		0,
+	} {
+		SetMarkdownFeatures(features)
+		for _, src := range hostileMarkdown {
+			for _, post := range []*store.Post{nil, post} {
+				out, err := markdown(src, post)
+				if err != nil {
+					t.Errorf("markdown(%q): %v", src, err)
+					continue
+				}
+				if problem := unsafeHTML(string(out)); problem != "" {
+					t.Errorf("markdown(%q) with features %q: %s in:\n%s",
+						src, features, problem, out)
+				}
+			}
+		}
+	}
+}
+
+// unsafeHTML returns a description of what is unsafe in s, or "" if nothing.
+// It checks on its own what sanitizeHTML and isSafeURL should ensure.
+func unsafeHTML(s string) string {
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.CommentToken, html.DoctypeToken:
+			return "comment or doctype"
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := z.Token()
+			allowed, ok := sanitizedAttrs[tok.DataAtom]
+			if !ok {
+				return "tag " + tok.Data
+			}
+			for _, attr := range tok.Attr {
+				key := strings.ToLower(attr.Key)
+				if strings.HasPrefix(key, "on") || key == "style" || !contains(allowed, key) {
+					return "attribute " + attr.Key + " on " + tok.Data
+				}
+				if (key == "href" || key == "src") && hasUnsafeScheme(attr.Val) {
+					return key + "=" + attr.Val
+				}
+				if key == "type" && attr.Val != "checkbox" {
+					return "input of type " + attr.Val
+				}
+			}
+		}
+	}
+}
+
+// hasUnsafeScheme reports whether a browser could take url (with character
+// references already resolved) to have a scheme other than http(s) or mailto.
+func hasUnsafeScheme(url string) bool {
+	var b strings.Builder
+	for _, r := range url {
+		if r > ' ' {
+			b.WriteRune(r)
+		}
+	}
+	s := strings.ToLower(b.String())
+	i := strings.IndexAny(s, ":/?#")
+	if i < 0 || s[i] != ':' {
+		return false
+	}
+	switch s[:i] {
+	case "http", "https", "mailto":
+		return false
+	}
+	return true
+}
+
+func TestMarkdownSafe(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{`[x](https://example.com/)`, `<a href="https://example.com/" rel="nofollow ugc">x</a>`},
+		{`[x](/rooms/ "t")`, `<a href="/rooms/" title="t">x</a>`},
+		{`[x](javascript:alert(1))`, `<a>x</a>`},
+		{`![a](https://example.com/a.png)`, `<img src="https://example.com/a.png" alt="a">`},
+		{`![a](data:image/png;base64,AAAA)`, `<img src="" alt="a">`},
+		{`<b>x</b>`, `<p>x</p>`},
+		{`a@example.com`, `<a href="mailto:a@example.com" rel="nofollow ugc">a@example.com</a>`},
+		{"- [x] done", `<input checked="" disabled="" type="checkbox"> done`},
+	}
+	for _, test := range tests {
+		out, err := markdown(test.src, nil)
+		if err != nil {
+			t.Errorf("markdown(%q): %v", test.src, err)
+			continue
+		}
+		if !strings.Contains(string(out), test.want) {
+			t.Errorf("markdown(%q) = %q, want it to contain %q", test.src, out, test.want)
+		}
+	}
+}
+
+// TestSanitizeHTML checks sanitizeHTML on its own, because the renderer
+// doesn't normally produce anything for it to remove.
+func TestSanitizeHTML(t *testing.T) {
+	for _, src := range []string{
+		`<a href="javascript:alert(1)" onclick="alert(1)">x</a>`,
+		`<a href="&#106;avascript:alert(1)">x</a>`,
+		`<a href=" JaVa	Script:alert(1)">x</a>`,
+		`<img src="data:image/svg+xml,x" onerror="alert(1)">`,
+		`<code class="language-go x">x</code>`,
+		`<p style="background:url(javascript:alert(1))">x</p>`,
+		`<input type="text" onfocus="alert(1)" autofocus>`,
+		`<script>alert(1)</script><iframe src="/"></iframe>`,
+		`<svg><a xlink:href="javascript:alert(1)">x</a></svg>`,
+		`<!-- x --><table><td align="center" onclick="alert(1)">x</td></table>`,
+	} {
+		out := sanitizeHTML(src)
+		if problem := unsafeHTML(out); problem != "" {
+			t.Errorf("sanitizeHTML(%q): %s in:\n%s", src, problem, out)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+)
+
+var modLogTpl = loadPageTemplate("modlog.html")
+
+// currentUser returns the logged-in user, or nil if there is none.
+func (s *Server) currentUser(r *http.Request) (*store.User, error) {
+	name, ok := s.userName(r)
+	if !ok {
+		return nil, nil
+	}
+	user, err := s.db.GetUser(r.Context(), name)
+	if errors.Is(err, store.ErrNotFound) {
+		// The session has outlived the user, e.g. with in-memory storage.
+		return nil, nil
+	}
+	return user, err
+}
+
+// userRole returns the role of the logged-in user, if any.
+// Failures are only logged, because the role only adds to what the user sees.
+func (s *Server) userRole(r *http.Request) store.Role {
+	user, err := s.currentUser(r)
+	if err != nil {
+		reqLogf(r, "failed to get user: %v", err)
+	}
+	if user == nil {
+		return store.RoleUser
+	}
+	return user.Role
+}
+
+var errNotLoggedIn = errors.New("not logged in")
+
+// bannedError is returned by checkActive for a banned user.
+type bannedError struct {
+	ban *store.Ban
+}
+
+func (err *bannedError) Error() string {
+	return banMessage(err.ban)
+}
+
+// checkActive returns the logged-in user if they are allowed to change things.
+// Otherwise, it returns errNotLoggedIn, a *bannedError, or a store error.
+func (s *Server) checkActive(r *http.Request) (*store.User, error) {
+	user, err := s.currentUser(r)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errNotLoggedIn
+	}
+	if user.Ban != nil {
+		return nil, &bannedError{user.Ban}
+	}
+	return user, nil
+}
+
+// activeUser is like checkActive, but responds with an error and returns nil
+// if the user is not allowed to change things.
+func (s *Server) activeUser(w http.ResponseWriter, r *http.Request) *store.User {
+	user, err := s.checkActive(r)
+	var banned *bannedError
+	switch {
+	case errors.Is(err, errNotLoggedIn):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.As(err, &banned):
+		s.renderError(w, r, http.StatusForbidden, err.Error())
+	case err != nil:
+		reqFatalf(w, r, err, "failed to get user")
+	}
+	return user
+}
+
+func banMessage(ban *store.Ban) string {
+	until := "permanently"
+	if !ban.Until.IsZero() {
+		until = "until " + ban.Until.Format("2006 Jan 2 15:04")
+	}
+	return fmt.Sprintf("You have been banned %s by %s: %s", until, ban.By, ban.Reason)
+}
+
+// logModAction adds action to the moderation log. The action has already
+// been taken, so failures are only logged.
+func (s *Server) logModAction(r *http.Request, action *store.ModAction) {
+	reqLogf(r, "moderation: %s %s %s %v %v %s", action.Moderator, action.Action,
+		action.User, action.RoomID.Hex(), action.Serial, action.Note)
+	if err := s.db.LogModAction(r.Context(), action); err != nil {
+		reqLogf(r, "failed to log moderation action: %v", err)
+	}
+}
+
+// postUser applies a moderator action to the user whose profile this is.
+func (s *Server) postUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	mod := s.activeUser(w, r)
+	if mod == nil {
+		return
+	}
+	if !mod.Role.CanModerate() {
+		http.Error(w, "not a moderator", http.StatusForbidden)
+		return
+	}
+	ctx := r.Context()
+	target, err := s.db.GetUser(ctx, ps.ByName("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get user")
+		return
+	}
+
+	action := &store.ModAction{Moderator: mod.Name, User: target.Name}
+	switch r.Form.Get("action") {
+	case "ban":
+		// Moderators can't ban each other; an admin must demote first.
+		if target.Role.CanModerate() {
+			http.Error(w, "cannot ban a moderator", http.StatusForbidden)
+			return
+		}
+		ban := &store.Ban{
+			Time:   time.Now(),
+			By:     mod.Name,
+			Reason: r.Form.Get("reason"),
+		}
+		if ban.Reason == "" {
+			http.Error(w, "reason required", http.StatusUnprocessableEntity)
+			return
+		}
+		days, err := strconv.Atoi(r.Form.Get("days"))
+		if err != nil || days < 0 {
+			http.Error(w, "bad number of days", http.StatusUnprocessableEntity)
+			return
+		}
+		if days > 0 {
+			ban.Until = ban.Time.AddDate(0, 0, days)
+		}
+		err = s.db.SetBan(ctx, target.Name, ban)
+		action.Action, action.Note = store.ModBan, ban.Reason
+		if days > 0 {
+			action.Note = fmt.Sprintf("%s (for %d days)", ban.Reason, days)
+		}
+	case "unban":
+		err = s.db.SetBan(ctx, target.Name, nil)
+		action.Action = store.ModUnban
+	case "set-role":
+		if mod.Role != store.RoleAdmin {
+			http.Error(w, "not an admin", http.StatusForbidden)
+			return
+		}
+		var role store.Role
+		role, err = store.ParseRole(r.Form.Get("role"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		err = s.db.SetRole(ctx, target.Name, role)
+		action.Action, action.Note = store.ModSetRole, role.String()
+	default:
+		http.Error(w, fmt.Sprintf("bad action %q", r.Form.Get("action")),
+			http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to %s", action.Action)
+		return
+	}
+	s.logModAction(r, action)
+	http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+}
+
+// postState changes the state of room.
+func (s *Server) postState(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	mod := s.activeUser(w, r)
+	if mod == nil {
+		return
+	}
+	if !mod.Role.CanModerate() {
+		http.Error(w, "not a moderator", http.StatusForbidden)
+		return
+	}
+	state, err := store.ParseRoomState(r.Form.Get("state"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.db.SetRoomState(r.Context(), room, state); err != nil {
+		reqFatalf(w, r, err, "failed to change room state")
+		return
+	}
+	action := &store.ModAction{
+		Moderator: mod.Name,
+		Action:    store.ModReopenRoom,
+		RoomID:    room.ID,
+		Note:      r.Form.Get("reason"),
+	}
+	switch state {
+	case store.RoomLocked:
+		action.Action = store.ModLockRoom
+	case store.RoomArchived:
+		action.Action = store.ModArchiveRoom
+	}
+	s.logModAction(r, action)
+	if isXHR(r) {
+		s.renderFragment(w, r, roomTpl, "roominfo", roomPayload{Room: room})
+	} else {
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+	}
+}
+
+// getModLog shows recent moderator actions to moderators.
+func (s *Server) getModLog(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.userRole(r).CanModerate() {
+		http.Error(w, "not a moderator", http.StatusForbidden)
+		return
+	}
+	actions, err := s.db.GetModLog(r.Context(), 200)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get moderation log")
+		return
+	}
+	s.renderPage(w, r, modLogTpl, actions)
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+)
+
+var historyTpl = loadPageTemplate("history.html", "post.html")
+
+func (s *Server) withPost(
+	next func(w http.ResponseWriter, r *http.Request, room *store.Room, post *store.Post),
+) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		serial, err := strconv.ParseUint(ps.ByName("serial"), 10, 64)
+		if err != nil {
+			http.Error(w, "no such post", http.StatusNotFound)
+			return
+		}
+		s.withRoom(func(w http.ResponseWriter, r *http.Request, room *store.Room) {
+			post, err := s.db.GetPost(r.Context(), room, serial)
+			if errors.Is(err, store.ErrNotFound) {
+				http.Error(w, "no such post", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				reqFatalf(w, r, err, "failed to get post")
+				return
+			}
+			next(w, r, room, post)
+		})(w, r, ps)
+	}
+}
+
+type postPayload struct {
+	Room *store.Room
+	Post *store.Post
+}
+
+func (s *Server) getPost(
+	w http.ResponseWriter, r *http.Request,
+	room *store.Room, post *store.Post,
+) {
+	if !isXHR(r) {
+		s.renderPage(w, r, historyTpl, postPayload{room, post})
+		return
+	}
+	if r.Form.Get("edit") != "" {
+		s.renderPost(w, r, "editform", post)
+		return
+	}
+	s.renderPost(w, r, "post", post)
+}
+
+func (s *Server) postPost(
+	w http.ResponseWriter, r *http.Request,
+	room *store.Room, post *store.Post,
+) {
+	user := s.activeUser(w, r)
+	if user == nil {
+		return
+	}
+	moderating := user.Name != post.Author
+	if moderating && !user.Role.CanModerate() {
+		http.Error(w, "cannot change someone else's post", http.StatusForbidden)
+		return
+	}
+	if room.State != store.RoomOpen && !user.Role.CanModerate() {
+		http.Error(w, "room is "+room.State.String(), http.StatusConflict)
+		return
+	}
+	if !post.Deleted.IsZero() {
+		http.Error(w, "post is deleted", http.StatusConflict)
+		return
+	}
+
+	action := &store.ModAction{
+		Moderator: user.Name,
+		Action:    store.ModEditPost,
+		User:      post.Author,
+		RoomID:    room.ID,
+		Serial:    post.Serial,
+	}
+	if r.Form.Get("action") == "delete" {
+		action.Action = store.ModDeletePost
+		if err := s.db.DeletePost(r.Context(), post, user.Name); err != nil {
+			reqFatalf(w, r, err, "failed to delete post")
+			return
+		}
+	} else {
+		text := r.Form.Get("text")
+		if text == "" {
+			http.Error(w, "text required", http.StatusUnprocessableEntity)
+			return
+		}
+		err := s.db.EditPost(r.Context(), post, user.Name, text)
+		if errors.Is(err, store.ErrNotFound) {
+			// Deleted since we got it.
+			http.Error(w, "post is deleted", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			reqFatalf(w, r, err, "failed to edit post")
+			return
+		}
+	}
+	if moderating {
+		s.logModAction(r, action)
+	}
+
+	if isXHR(r) {
+		s.renderPost(w, r, "post", post)
+	} else {
+		http.Redirect(w, r, postURL(room.ID, post.Serial), http.StatusSeeOther)
+	}
+}
+
+// renderPost renders the fragment name (from post.html) for post as seen by
+// the current user. Unlike renderFragment, it doesn't wrap post in page data,
+// because these fragments are also rendered into SSE messages.
+func (s *Server) renderPost(
+	w http.ResponseWriter, r *http.Request,
+	name string, post *store.Post,
+) {
+	userName, _ := s.userName(r)
+	view := postView{post, userName, s.userRole(r), s.csrfToken(w, r)}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := historyTpl.ExecuteTemplate(w, name, view); err != nil {
+		reqLogf(r, "failed to render HTML: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var profileTpl = loadPageTemplate("profile.html")
+
+type profilePayload struct {
+	Profile *store.Profile
+	User    *store.User // for role and ban
+	Posts   []*store.Post
+	Rooms   map[primitive.ObjectID]*store.Room // of Posts
+	Next    string                             // cursor for older posts, if any
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	profile, err := s.db.GetProfile(ctx, ps.ByName("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get profile")
+		return
+	}
+
+	// Get one extra post to see if there are older ones.
+	const pageSize = 20
+	posts, err := s.db.GetPostsByAuthor(ctx, profile.Name, r.Form.Get("before"), pageSize+1)
+	if errors.Is(err, store.ErrBadCursor) {
+		http.Error(w, "bad query string: bad cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get posts")
+		return
+	}
+	user, err := s.db.GetUser(ctx, profile.Name)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get user")
+		return
+	}
+	payload := profilePayload{Profile: profile, User: user, Posts: posts}
+	if len(posts) > pageSize {
+		payload.Posts = posts[:pageSize]
+		payload.Next = store.PostCursor(posts[pageSize-1])
+	}
+	payload.Rooms, err = s.getRoomsOf(r, payload.Posts)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get rooms")
+		return
+	}
+
+	if isXHR(r) {
+		s.renderFragment(w, r, profileTpl, "posts", payload)
+	} else {
+		s.renderPage(w, r, profileTpl, payload)
+	}
+}
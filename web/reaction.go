@@ -0,0 +1,88 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vfaronov/nnbb/store"
+)
+
+// reactionEmoji are the emoji that users can react with, in display order.
+var reactionEmoji = []string{"👍", "👎", "😄", "🎉", "😕", "❤️", "🚀", "👀"}
+
+// reactionCount is what the "reactions" template renders for each emoji.
+type reactionCount struct {
+	Emoji string
+	Users []string // who reacted with Emoji, oldest first
+	Mine  bool     // whether the current user is among Users
+}
+
+// Who returns the names of Users for display.
+func (count reactionCount) Who() string {
+	return strings.Join(count.Users, ", ")
+}
+
+// countReactions returns the reactions to post grouped by emoji,
+// as seen by user (who may be empty).
+func countReactions(post *store.Post, user string) []reactionCount {
+	var counts []reactionCount
+	for _, emoji := range reactionEmoji {
+		count := reactionCount{Emoji: emoji}
+		for _, reaction := range post.Reactions {
+			if reaction.Emoji == emoji {
+				count.Users = append(count.Users, reaction.User)
+				count.Mine = count.Mine || reaction.User == user
+			}
+		}
+		if len(count.Users) > 0 {
+			counts = append(counts, count)
+		}
+	}
+	return counts
+}
+
+// getReactions renders the reactions to post, which the client
+// fetches when the stream tells it that they have changed.
+func (s *Server) getReactions(
+	w http.ResponseWriter, r *http.Request,
+	room *store.Room, post *store.Post,
+) {
+	s.renderPost(w, r, "reactions", post)
+}
+
+// postReactions toggles the current user's reaction to post
+// with the emoji from the form.
+func (s *Server) postReactions(
+	w http.ResponseWriter, r *http.Request,
+	room *store.Room, post *store.Post,
+) {
+	user := s.activeUser(w, r)
+	if user == nil {
+		return
+	}
+	emoji := r.Form.Get("emoji")
+	if !contains(reactionEmoji, emoji) {
+		http.Error(w, "bad emoji", http.StatusUnprocessableEntity)
+		return
+	}
+	if room.State != store.RoomOpen {
+		http.Error(w, "room is "+room.State.String(), http.StatusConflict)
+		return
+	}
+	_, err := s.db.ToggleReaction(r.Context(), post, user.Name, emoji)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "post is deleted", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to toggle reaction")
+		return
+	}
+
+	if isXHR(r) {
+		s.renderPost(w, r, "reactions", post)
+	} else {
+		http.Redirect(w, r, postURL(room.ID, post.Serial), http.StatusSeeOther)
+	}
+}
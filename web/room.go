@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -11,7 +12,10 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-var roomTpl = loadPageTemplate("room.html")
+var (
+	roomTpl     = loadPageTemplate("room.html", "post.html")
+	roomInfoTpl = loadPageTemplate("roominfo.html")
+)
 
 func (s *Server) withRoom(
 	next func(w http.ResponseWriter, r *http.Request, room *store.Room),
@@ -45,11 +49,15 @@ type roomPayload struct {
 	Posts                []*store.Post
 	FirstPost, LastPost  *store.Post
 	Preceding, Following uint64
+	LastRead             uint64      // by the current user before this request
+	Watching             bool        // by the current user
+	ReplyTo              *store.Post // for the post form, if replying
 }
 
-func (s *Server) getRoom(w http.ResponseWriter, r *http.Request, room *store.Room) {
-	var err error
-	var before, since uint64
+// parsePage returns the page of posts in room requested by the before or
+// since query parameter. If neither is given, the page is the latest posts.
+// Exactly one of the returned values is non-zero.
+func parsePage(r *http.Request, room *store.Room) (before, since uint64, err error) {
 	if s := r.Form.Get("before"); s != "" {
 		before, err = strconv.ParseUint(s, 10, 32)
 	}
@@ -60,22 +68,33 @@ func (s *Server) getRoom(w http.ResponseWriter, r *http.Request, room *store.Roo
 		err = errors.New("cannot specify both before and since")
 	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad query string: %v", err),
-			http.StatusBadRequest)
-		return
+		return 0, 0, err
 	}
 	if before == 0 && since == 0 {
 		before = room.Serial + 1
 	}
+	return before, since, nil
+}
 
-	var posts []*store.Post
+// getPage returns the page of posts in room identified by parsePage.
+func (s *Server) getPage(
+	ctx context.Context, room *store.Room, before, since uint64,
+) ([]*store.Post, error) {
 	const pageSize = 20
-	ctx := r.Context()
 	if before > 0 {
-		posts, err = s.db.GetPostsBefore(ctx, room, before, pageSize)
-	} else {
-		posts, err = s.db.GetPostsSince(ctx, room, since, pageSize)
+		return s.db.GetPostsBefore(ctx, room, before, pageSize)
 	}
+	return s.db.GetPostsSince(ctx, room, since, pageSize)
+}
+
+func (s *Server) getRoom(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	before, since, err := parsePage(r, room)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad query string: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+	posts, err := s.getPage(r.Context(), room, before, since)
 	if err != nil {
 		reqFatalf(w, r, err, "failed to get posts")
 		return
@@ -86,6 +105,15 @@ func (s *Server) getRoom(w http.ResponseWriter, r *http.Request, room *store.Roo
 		Room:  room,
 		Posts: posts,
 	}
+	if userName, ok := s.userName(r); ok {
+		if !fragment {
+			payload.ReplyTo = s.getReplyTo(r, room)
+		}
+		payload.LastRead = s.markRead(r, userName, room, posts)
+		if !fragment {
+			payload.Watching = s.isWatching(r, userName, room)
+		}
+	}
 	if len(posts) > 0 {
 		payload.FirstPost = posts[0]
 		payload.LastPost = posts[len(posts)-1]
@@ -110,29 +138,157 @@ func (s *Server) getRoom(w http.ResponseWriter, r *http.Request, room *store.Roo
 }
 
 func (s *Server) postRoom(w http.ResponseWriter, r *http.Request, room *store.Room) {
-	userName, ok := s.userName(r)
-	if !ok {
-		http.Error(w, "not logged in", http.StatusForbidden)
+	user := s.activeUser(w, r)
+	if user == nil {
 		return
 	}
 	post := &store.Post{
 		RoomID: room.ID,
-		Author: userName,
+		Author: user.Name,
 		Text:   r.Form.Get("text"),
 	}
 	if post.Text == "" {
 		http.Error(w, "text required", http.StatusUnprocessableEntity)
 		return
 	}
+	if v := r.Form.Get("reply_to"); v != "" {
+		var err error
+		if post.ReplyTo, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "bad reply_to", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	var err error
+	post.Attachments, err = s.saveAttachments(r)
+	var bad *attachmentError
+	if errors.As(err, &bad) {
+		http.Error(w, bad.msg, bad.status)
+		return
+	}
+	if err != nil {
+		reqFatalf(w, r, err, "failed to save attachments")
+		return
+	}
 
-	if err := s.db.CreatePost(r.Context(), post); err != nil {
+	err = s.db.CreatePost(r.Context(), post)
+	if err != nil {
+		s.discardAttachments(r, post.Attachments)
+	}
+	var closed *store.RoomClosedError
+	if errors.As(err, &closed) {
+		if isXHR(r) {
+			// Swap the form out for a notice, as if the stream had told us.
+			room.State = closed.State
+			s.renderFragment(w, r, roomTpl, "postform", roomPayload{Room: room})
+		} else {
+			s.renderError(w, r, http.StatusConflict, fmt.Sprintf(
+				"This room is %s, so no new posts can be made.", closed.State))
+		}
+		return
+	}
+	if errors.Is(err, store.ErrBadReply) {
+		http.Error(w, "no such post to reply to", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
 		reqFatalf(w, r, err, "failed to create post")
 		return
 	}
 
 	if isXHR(r) {
-		s.renderFragment(w, r, roomTpl, "postform", roomPayload{})
+		s.renderFragment(w, r, roomTpl, "postform", roomPayload{Room: room})
 	} else {
 		http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
 	}
 }
+
+// getReplyTo returns the post in room that the reply query parameter
+// asks to reply to, or nil if none. Failures are only logged.
+func (s *Server) getReplyTo(r *http.Request, room *store.Room) *store.Post {
+	serial, err := strconv.ParseUint(r.Form.Get("reply"), 10, 64)
+	if err != nil || serial == 0 {
+		return nil
+	}
+	post, err := s.db.GetPost(r.Context(), room, serial)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			reqLogf(r, "failed to get post to reply to: %v", err)
+		}
+		return nil
+	}
+	return post
+}
+
+func (s *Server) getRoomInfo(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	payload := roomPayload{Room: room}
+	switch {
+	case !isXHR(r):
+		s.renderPage(w, r, roomInfoTpl, payload)
+	case r.Form.Get("edit") != "":
+		s.renderFragment(w, r, roomInfoTpl, "roomform", payload)
+	case r.Form.Get("postform") != "":
+		payload.ReplyTo = s.getReplyTo(r, room)
+		s.renderFragment(w, r, roomTpl, "postform", payload)
+	default:
+		s.renderFragment(w, r, roomTpl, "roominfo", payload)
+	}
+}
+
+func (s *Server) postRoomInfo(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	user := s.activeUser(w, r)
+	if user == nil {
+		return
+	}
+	moderating := user.Name != room.Author
+	if moderating && !user.Role.CanModerate() {
+		http.Error(w, "cannot change someone else's room", http.StatusForbidden)
+		return
+	}
+	room.Title = r.Form.Get("title")
+	room.Description = r.Form.Get("description")
+	if room.Title == "" {
+		http.Error(w, "missing title in form", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.db.UpdateRoom(r.Context(), room); err != nil {
+		reqFatalf(w, r, err, "failed to update room")
+		return
+	}
+	if moderating {
+		s.logModAction(r, &store.ModAction{
+			Moderator: user.Name,
+			Action:    store.ModEditRoom,
+			User:      room.Author,
+			RoomID:    room.ID,
+		})
+	}
+
+	if isXHR(r) {
+		s.renderFragment(w, r, roomTpl, "roominfo", roomPayload{Room: room})
+	} else {
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+	}
+}
+
+// markRead moves userName's read marker in room past posts,
+// and returns where the marker was before. Read markers are not essential,
+// so failures are only logged.
+func (s *Server) markRead(
+	r *http.Request, userName string,
+	room *store.Room, posts []*store.Post,
+) uint64 {
+	ctx := r.Context()
+	markers, err := s.db.GetReadMarkers(ctx, userName, []primitive.ObjectID{room.ID})
+	if err != nil {
+		reqLogf(r, "failed to get read marker: %v", err)
+	}
+	lastRead := markers[room.ID]
+	if len(posts) > 0 && posts[len(posts)-1].Serial > lastRead {
+		err = s.db.MarkRead(ctx, userName, room.ID, posts[len(posts)-1].Serial)
+		if err != nil {
+			reqLogf(r, "failed to mark read: %v", err)
+		}
+	}
+	return lastRead
+}
@@ -1,31 +1,78 @@
 package web
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var roomsTpl = loadPageTemplate("rooms.html")
 
+type roomsPayload struct {
+	Rooms  []*store.Room
+	Unread map[primitive.ObjectID]*unread // for the current user
+	Orders []store.RoomOrder
+	Order  store.RoomOrder
+	After  string // cursor that Rooms start after, if any
+	Next   string // cursor for the next page, if any
+}
+
 func (s *Server) getRooms(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	rooms, err := s.db.GetRooms(r.Context())
+	order := store.ByUpdated
+	if sort := r.Form.Get("sort"); sort != "" {
+		var err error
+		order, err = store.ParseRoomOrder(sort)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad query string: %v", err),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	after := r.Form.Get("after")
+
+	// Get one extra room to see if there's a next page.
+	const pageSize = 50
+	rooms, err := s.db.GetRooms(r.Context(), order, after, pageSize+1)
+	if errors.Is(err, store.ErrBadCursor) {
+		http.Error(w, "bad query string: bad cursor", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		reqFatalf(w, r, err, "failed to get rooms")
 		return
 	}
-	s.renderPage(w, r, roomsTpl, struct{ Rooms []*store.Room }{rooms})
+
+	payload := roomsPayload{
+		Rooms:  rooms,
+		Orders: []store.RoomOrder{store.ByUpdated, store.ByCreated, store.ByPosts, store.ByTitle},
+		Order:  order,
+		After:  after,
+	}
+	if len(rooms) > pageSize {
+		payload.Rooms = rooms[:pageSize]
+		payload.Next = order.Cursor(rooms[pageSize-1])
+	}
+	if userName, ok := s.userName(r); ok {
+		payload.Unread = s.getUnread(r, userName, payload.Rooms)
+	}
+	if isXHR(r) {
+		s.renderFragment(w, r, roomsTpl, "rooms", payload)
+	} else {
+		s.renderPage(w, r, roomsTpl, payload)
+	}
 }
 
 func (s *Server) postRooms(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	name, ok := s.userName(r)
-	if !ok {
-		http.Error(w, "not logged in", http.StatusForbidden)
+	user := s.activeUser(w, r)
+	if user == nil {
 		return
 	}
 	room := &store.Room{
-		Author: name,
+		Author: user.Name,
 		Title:  r.Form.Get("title"),
 	}
 	if room.Title == "" {
@@ -38,3 +85,33 @@ func (s *Server) postRooms(w http.ResponseWriter, r *http.Request, ps httprouter
 	}
 	http.Redirect(w, r, room.ID.Hex()+"/", http.StatusSeeOther)
 }
+
+// unread describes the posts in a room that the user has not read yet.
+type unread struct {
+	Count    uint64
+	LastRead uint64
+}
+
+// getUnread returns unread posts in those of rooms that userName has read
+// before (there's no point in showing every other room as unread).
+// Read markers are not essential, so failures are only logged.
+func (s *Server) getUnread(
+	r *http.Request, userName string, rooms []*store.Room,
+) map[primitive.ObjectID]*unread {
+	ids := make([]primitive.ObjectID, len(rooms))
+	for i, room := range rooms {
+		ids[i] = room.ID
+	}
+	markers, err := s.db.GetReadMarkers(r.Context(), userName, ids)
+	if err != nil {
+		reqLogf(r, "failed to get read markers: %v", err)
+		return nil
+	}
+	result := make(map[primitive.ObjectID]*unread)
+	for _, room := range rooms {
+		if lastRead, ok := markers[room.ID]; ok && room.Serial > lastRead {
+			result[room.ID] = &unread{room.Serial - lastRead, lastRead}
+		}
+	}
+	return result
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var searchTpl = loadPageTemplate("search.html")
+
+type searchPayload struct {
+	Form    searchForm
+	Results *store.SearchResults
+	Rooms   map[primitive.ObjectID]*store.Room // of Results.Posts
+}
+
+// searchForm holds the search parameters as the user entered them.
+type searchForm struct {
+	Q, Author, Since, Until string
+	Room                    *store.Room
+}
+
+func (s *Server) getSearch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	form := searchForm{
+		Q:      r.Form.Get("q"),
+		Author: r.Form.Get("author"),
+		Since:  r.Form.Get("since"),
+		Until:  r.Form.Get("until"),
+	}
+	q := &store.SearchQuery{
+		Text:   form.Q,
+		Author: form.Author,
+	}
+	var err error
+	if form.Since != "" {
+		q.Since, err = time.Parse(dateLayout, form.Since)
+	}
+	if form.Until != "" && err == nil {
+		q.Until, err = time.Parse(dateLayout, form.Until)
+		// The form's range is inclusive.
+		q.Until = q.Until.AddDate(0, 0, 1)
+	}
+	if hex := r.Form.Get("room"); hex != "" && err == nil {
+		q.RoomID, err = primitive.ObjectIDFromHex(hex)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad query string: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+	if !q.RoomID.IsZero() {
+		form.Room, err = s.db.GetRoom(ctx, q.RoomID)
+		if err != nil {
+			reqFatalf(w, r, err, "failed to get room")
+			return
+		}
+		if form.Room == nil {
+			http.Error(w, "no such room", http.StatusNotFound)
+			return
+		}
+	}
+
+	payload := searchPayload{Form: form}
+	if q.Text != "" {
+		const limit = 50
+		payload.Results, err = s.db.Search(ctx, q, limit)
+		if err != nil {
+			reqFatalf(w, r, err, "failed to search")
+			return
+		}
+		payload.Rooms, err = s.getRoomsOf(r, payload.Results.Posts)
+		if err != nil {
+			reqFatalf(w, r, err, "failed to get rooms")
+			return
+		}
+	}
+	s.renderPage(w, r, searchTpl, payload)
+}
+
+// getRoomsOf returns the rooms of posts, so they can be shown
+// with the room titles.
+func (s *Server) getRoomsOf(
+	r *http.Request, posts []*store.Post,
+) (map[primitive.ObjectID]*store.Room, error) {
+	seen := make(map[primitive.ObjectID]bool)
+	var ids []primitive.ObjectID
+	for _, post := range posts {
+		if !seen[post.RoomID] {
+			seen[post.RoomID] = true
+			ids = append(ids, post.RoomID)
+		}
+	}
+	return s.db.GetRoomsByID(r.Context(), ids)
+}
+
+// dateLayout is the format of dates in HTML <input type=date>.
+const dateLayout = "2006-01-02"
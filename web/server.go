@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/julienschmidt/httprouter"
 	"github.com/vfaronov/nnbb/store"
@@ -20,11 +21,15 @@ var (
 	static, _    = fs.Sub(assets, "static")
 )
 
-func NewServer(addr string, db *store.DB, key []byte) *Server {
+func NewServer(addr string, db store.Store, key []byte) *Server {
 	s := &Server{
-		Server:       &http.Server{Addr: addr},
-		db:           db,
-		sessionStore: sessions.NewCookieStore(key),
+		Server:            &http.Server{Addr: addr},
+		Backpressure:      store.BackpressureResync,
+		MaxAttachmentSize: defaultMaxAttachmentSize,
+		db:                db,
+		sessionStore:      sessions.NewCookieStore(key),
+		tokens:            newTokenCodec(key),
+		typing:            newTypingHub(),
 	}
 
 	r := httprouter.New()
@@ -32,26 +37,74 @@ func NewServer(addr string, db *store.DB, key []byte) *Server {
 	r.GET("/signup/", s.getSignup)
 	r.POST("/signup/", s.postSignup)
 	r.POST("/logout/", s.postLogout)
+	r.GET("/feed/", s.getRoomsFeed)
+	r.GET("/users/:name/", s.getProfile)
+	r.GET("/users/:name/feed/", s.getUserFeed)
+	r.POST("/users/:name/", s.postUser)
+	r.GET("/modlog/", s.getModLog)
+	r.GET("/search/", s.getSearch)
+	r.GET("/inbox/", s.getInbox)
+	r.GET("/inbox/updates/", s.getInboxUpdates)
+	r.GET("/watching/", s.getWatching)
+	r.GET("/watching/updates/", s.getWatchingUpdates)
+	r.GET("/watching/rooms/:roomID/", s.withRoom(s.getWatchedRoom))
 	r.GET("/rooms/", s.getRooms)
 	r.POST("/rooms/", s.postRooms)
 	r.GET("/rooms/:roomID/", s.withRoom(s.getRoom))
 	r.POST("/rooms/:roomID/", s.withRoom(s.postRoom))
 	r.GET("/rooms/:roomID/updates/", s.withRoom(s.getRoomUpdates))
+	r.GET("/rooms/:roomID/socket/", s.withRoom(s.getRoomSocket))
+	r.GET("/rooms/:roomID/feed/", s.withRoom(s.getRoomFeed))
+	r.GET("/rooms/:roomID/info/", s.withRoom(s.getRoomInfo))
+	r.POST("/rooms/:roomID/info/", s.withRoom(s.postRoomInfo))
+	r.POST("/rooms/:roomID/watch/", s.withRoom(s.postWatch))
+	r.POST("/rooms/:roomID/state/", s.withRoom(s.postState))
+	r.GET("/rooms/:roomID/posts/:serial/", s.withPost(s.getPost))
+	r.POST("/rooms/:roomID/posts/:serial/", s.withPost(s.postPost))
+	r.GET("/rooms/:roomID/posts/:serial/reactions/", s.withPost(s.getReactions))
+	r.POST("/rooms/:roomID/posts/:serial/reactions/", s.withPost(s.postReactions))
+	r.GET("/blobs/:key/:name", s.getBlob)
+	s.routeAPI(r)
 
-	s.Server.Handler = withReqID(withForm(r))
+	s.Server.Handler = withReqID(s.withForm(s.withCSRF(r)))
 
 	return s
 }
 
 type Server struct {
 	*http.Server
-	db           *store.DB
-	sessionStore *sessions.CookieStore
+	// Backpressure is the policy for SSE clients that don't keep up
+	// with new posts. It may be changed before the server is started.
+	Backpressure store.Backpressure
+	// Blobs keeps the files attached to posts. If it's nil, which is
+	// the default, files cannot be attached. It may be set before
+	// the server is started, as may MaxAttachmentSize.
+	Blobs             store.BlobStore
+	MaxAttachmentSize int64
+	db                store.Store
+	sessionStore      *sessions.CookieStore
+	tokens            *securecookie.SecureCookie
+	typing            *typingHub
 }
 
-func withForm(next http.Handler) http.Handler {
+// withForm parses the form in the request, including files uploaded
+// as multipart/form-data, which are limited in size by s.maxFormSize.
+func (s *Server) withForm(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
+		var err error
+		if mediaType(r.Header.Get("Content-Type")) == "multipart/form-data" {
+			limit := s.maxFormSize(r)
+			if r.ContentLength > limit {
+				http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			// The files are removed by net/http when the handler returns.
+			err = r.ParseMultipartForm(multipartMemory)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
 			// TODO: nicer HTML errors here and everywhere else
 			http.Error(w, fmt.Sprintf("cannot parse form: %v", err),
 				http.StatusBadRequest)
@@ -72,16 +125,7 @@ func (s *Server) renderFragment(
 	w http.ResponseWriter, r *http.Request,
 	tpl *template.Template, name string, payload interface{},
 ) {
-	userName, _ := s.userName(r) // may be empty
-	data := struct {
-		User string
-		URL  *url.URL
-		P    interface{}
-	}{
-		User: userName,
-		URL:  r.URL,
-		P:    payload,
-	}
+	data := s.pageData(w, r, payload)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	var err error
 	if name == "" {
@@ -96,6 +140,40 @@ func (s *Server) renderFragment(
 	}
 }
 
+// pageData is what page templates render.
+type pageData struct {
+	User string     // may be empty
+	Role store.Role // of User
+	Ban  *store.Ban // of User, if any
+	CSRF string     // must be included in every form (see withCSRF)
+	// Uploads is whether files can be attached to posts.
+	Uploads bool
+	URL     *url.URL
+	P       interface{}
+}
+
+func (s *Server) pageData(w http.ResponseWriter, r *http.Request, payload interface{}) pageData {
+	userName, _ := s.userName(r)
+	data := pageData{
+		User:    userName,
+		CSRF:    s.csrfToken(w, r),
+		Uploads: s.Blobs != nil,
+		URL:     r.URL,
+		P:       payload,
+	}
+	// The role and ban only add to what the user sees, so failures
+	// are only logged. Handlers check them again with activeUser.
+	user, err := s.currentUser(r)
+	if err != nil {
+		reqLogf(r, "failed to get user: %v", err)
+	}
+	if user != nil {
+		data.Role = user.Role
+		data.Ban = user.Ban
+	}
+	return data
+}
+
 func isXHR(r *http.Request) bool {
 	return r.Header.Get("X-Requested-With") == "XMLHttpRequest"
 }
@@ -107,6 +185,7 @@ const (
 	reqIDKey key = iota
 )
 
-func loadPageTemplate(name string) *template.Template {
-	return template.Must(template.New("page.html").Funcs(funcMap).ParseFS(templates, "page.html", name))
+func loadPageTemplate(names ...string) *template.Template {
+	patterns := append([]string{"page.html"}, names...)
+	return template.Must(template.New("page.html").Funcs(funcMap).ParseFS(templates, patterns...))
 }
@@ -0,0 +1,18 @@
+package web
+
+import (
+	"testing"
+
+	"github.com/vfaronov/nnbb/store"
+)
+
+// newTestServer returns a Server backed by a fresh MemDB.
+func newTestServer(t *testing.T) (*Server, *store.MemDB) {
+	t.Helper()
+	db, err := store.NewMemDB(store.NewLocalBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.CancelStreams)
+	return NewServer("localhost:0", db, []byte("test key")), db
+}
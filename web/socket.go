@@ -0,0 +1,333 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The WebSocket at /rooms/:roomID/socket/ delivers the same posts as
+// getRoomUpdates, as JSON messages like {"type": "post", "post": {...}},
+// with the types "post", "edited", "deleted", "reacted" and "room"
+// (with "room": {...}).
+// To resume after a disconnect, the client reconnects with ?since=
+// the serial of the last post it got.
+//
+// The client may send:
+//
+//	{"type": "post", "ref": "1", "text": "...", "reply_to": 41}
+//	{"type": "typing"}
+//	{"type": "ack", "serial": 42}
+//
+// where "reply_to" is optional. A new post is answered with {"type": "ack", "ref": "1", "post": {...}}
+// or {"type": "error", "ref": "1", "error": {...}} with the same error object
+// as in the JSON API. The new post also comes in the stream as usual.
+// Typing indicators are relayed to other sockets in the room
+// as {"type": "typing", "user": "..."}. Acks mark posts as read,
+// so unlike with SSE, posts are only marked when the client says so.
+
+const (
+	socketWriteTimeout = 10 * time.Second
+	socketPingInterval = 30 * time.Second
+	socketPongTimeout  = 2 * socketPingInterval
+	socketReadLimit    = 64 << 10
+	typingInterval     = time.Second // minimum between relayed indicators
+)
+
+// The default CheckOrigin rejects cross-origin requests, which is what
+// protects sockets authenticated by the session cookie (withCSRF only
+// checks POST requests). Clients without an Origin header are let through.
+var upgrader = websocket.Upgrader{}
+
+type socketMessage struct {
+	Type  string          `json:"type"`
+	Ref   string          `json:"ref,omitempty"`
+	Post  *apiPost        `json:"post,omitempty"`
+	Room  *apiRoom        `json:"room,omitempty"`
+	User  string          `json:"user,omitempty"`
+	Error *apiErrorObject `json:"error,omitempty"`
+}
+
+type socketRequest struct {
+	Type    string `json:"type"`
+	Ref     string `json:"ref"`
+	Text    string `json:"text"`
+	ReplyTo uint64 `json:"reply_to"`
+	Serial  uint64 `json:"serial"`
+}
+
+func (s *Server) getRoomSocket(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	ctx := r.Context()
+	var since uint64
+	if v := r.Form.Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Same as in getRoomUpdates.
+	events := s.db.StreamRoom(room.ID, s.Backpressure)
+	defer s.db.CancelStream(events)
+
+	var posts []*store.Post
+	if since > 0 {
+		var err error
+		posts, err = s.db.GetPostsSince(ctx, room, since, 0)
+		if err != nil {
+			reqFatalf(w, r, err, "failed to get initial posts")
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error.
+		reqLogf(r, "failed to upgrade to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	typing := s.typing.join(room.ID)
+	defer s.typing.leave(room.ID, typing)
+
+	// The socket is read in a separate goroutine, while this one
+	// does all the writing, as required by the websocket package.
+	done := make(chan struct{})
+	defer close(done)
+	requests := make(chan []byte)
+	readErr := make(chan error, 1)
+	go readSocket(conn, requests, readErr, done)
+
+	sock := &roomSocket{
+		s:        s,
+		r:        r,
+		conn:     conn,
+		room:     room,
+		typingCh: typing,
+		feed:     newRoomFeed(s.db, r, room, since, socketRoomEncoder{conn}),
+	}
+	sock.markedRead = since
+	if err := sock.feed.sendFetched(posts); err != nil {
+		reqLogf(r, "failed to send initial posts: %v", err)
+		return
+	}
+
+	reqLogf(r, "start socket (initial cutoff at %v)", sock.feed.cutoff)
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+loop:
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				err = errors.New("DB abandoned listener")
+				break loop
+			}
+			err = sock.feed.handle(ctx, ev)
+		case data := <-requests:
+			err = sock.handle(data)
+		case err = <-readErr:
+			break loop
+		case user := <-typing:
+			err = sendSocket(conn, socketMessage{Type: "typing", User: user})
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(socketWriteTimeout))
+		}
+		if err != nil {
+			break loop
+		}
+	}
+	reqLogf(r, "stop socket: %v", err)
+	_ = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(socketWriteTimeout))
+}
+
+// readSocket sends messages from conn to requests until an error,
+// which it sends to readErr, or until done is closed.
+func readSocket(conn *websocket.Conn, requests chan<- []byte, readErr chan<- error, done <-chan struct{}) {
+	conn.SetReadLimit(socketReadLimit)
+	_ = conn.SetReadDeadline(time.Now().Add(socketPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(socketPongTimeout))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(socketPongTimeout))
+		select {
+		case requests <- data:
+		case <-done:
+			return
+		}
+	}
+}
+
+// roomSocket is the state of a getRoomSocket connection.
+type roomSocket struct {
+	s          *Server
+	r          *http.Request
+	conn       *websocket.Conn
+	room       *store.Room
+	feed       *roomFeed
+	typingCh   chan string // from typingHub.join
+	markedRead uint64
+	lastTyping time.Time
+}
+
+// handle responds to a message from the client. It only returns an error
+// if the connection is broken; bad requests are answered with error messages.
+func (sock *roomSocket) handle(data []byte) error {
+	var req socketRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return sock.fail(req.Ref, apiErrorObject{"bad_request", "cannot parse message: " + err.Error()})
+	}
+	switch req.Type {
+	case "post":
+		return sock.post(req)
+	case "typing":
+		return sock.typing(req)
+	case "ack":
+		// The client can't acknowledge posts it hasn't seen.
+		serial := req.Serial
+		if serial > sock.feed.lastSent {
+			serial = sock.feed.lastSent
+		}
+		user, _ := sock.s.userName(sock.r)
+		sock.s.markStreamed(sock.r, user, sock.room, &sock.markedRead, serial)
+		return nil
+	default:
+		return sock.fail(req.Ref, apiErrorObject{"bad_request", "unknown message type"})
+	}
+}
+
+func (sock *roomSocket) post(req socketRequest) error {
+	user, err := sock.s.checkActive(sock.r)
+	if err != nil {
+		return sock.failErr(req.Ref, err, "user")
+	}
+	if req.Text == "" {
+		return sock.fail(req.Ref, apiErrorObject{"bad_request", "text required"})
+	}
+	post := &store.Post{
+		RoomID:  sock.room.ID,
+		Author:  user.Name,
+		Text:    req.Text,
+		ReplyTo: req.ReplyTo,
+	}
+	if err := sock.s.db.CreatePost(sock.r.Context(), post); err != nil {
+		return sock.failErr(req.Ref, err, "failed to create post")
+	}
+	return sendSocket(sock.conn, socketMessage{Type: "ack", Ref: req.Ref, Post: newAPIPost(post)})
+}
+
+func (sock *roomSocket) typing(req socketRequest) error {
+	user, err := sock.s.checkActive(sock.r)
+	if err != nil {
+		return sock.failErr(req.Ref, err, "user")
+	}
+	if time.Since(sock.lastTyping) < typingInterval {
+		return nil
+	}
+	sock.lastTyping = time.Now()
+	sock.s.typing.notify(sock.room.ID, sock.typingCh, user.Name)
+	return nil
+}
+
+func (sock *roomSocket) fail(ref string, obj apiErrorObject) error {
+	return sendSocket(sock.conn, socketMessage{Type: "error", Ref: ref, Error: &obj})
+}
+
+func (sock *roomSocket) failErr(ref string, err error, format string, v ...interface{}) error {
+	_, obj := describeError(sock.r, err, format, v...)
+	return sock.fail(ref, obj)
+}
+
+func sendSocket(conn *websocket.Conn, msg socketMessage) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(msg)
+}
+
+// socketRoomEncoder sends the events of a roomFeed over a WebSocket.
+type socketRoomEncoder struct {
+	conn *websocket.Conn
+}
+
+func (enc socketRoomEncoder) newPost(post *store.Post) error {
+	return sendSocket(enc.conn, socketMessage{Type: "post", Post: newAPIPost(post)})
+}
+
+func (enc socketRoomEncoder) changedPost(typ store.EventType, post *store.Post) error {
+	return sendSocket(enc.conn, socketMessage{Type: changedEventName(typ), Post: newAPIPost(post)})
+}
+
+func (enc socketRoomEncoder) updatedRoom(room *store.Room, stateChanged bool) error {
+	return sendSocket(enc.conn, socketMessage{Type: "room", Room: newAPIRoom(room)})
+}
+
+// typingHub relays typing indicators between the sockets in each room.
+// It only knows about sockets in this process, so typing indicators,
+// unlike posts, don't reach clients of other nnbb processes.
+type typingHub struct {
+	mu    sync.Mutex
+	rooms map[primitive.ObjectID]map[chan string]bool
+}
+
+func newTypingHub() *typingHub {
+	return &typingHub{rooms: make(map[primitive.ObjectID]map[chan string]bool)}
+}
+
+// join returns a channel that receives the names of users typing in room.
+// A user typing into several sockets will see their own name in the others.
+func (h *typingHub) join(roomID primitive.ObjectID) chan string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan string, 16)
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[chan string]bool)
+	}
+	h.rooms[roomID][ch] = true
+	return ch
+}
+
+func (h *typingHub) leave(roomID primitive.ObjectID, ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.rooms[roomID], ch)
+	if len(h.rooms[roomID]) == 0 {
+		delete(h.rooms, roomID)
+	}
+}
+
+// notify tells every socket in room, except the one with channel from,
+// that user is typing. Sockets that are behind simply miss the indicator.
+func (h *typingHub) notify(roomID primitive.ObjectID, from chan string, user string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.rooms[roomID] {
+		if ch == from {
+			continue
+		}
+		select {
+		case ch <- user:
+		default:
+		}
+	}
+}
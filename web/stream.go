@@ -1,10 +1,15 @@
 package web
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/vfaronov/nnbb/store"
 )
@@ -19,6 +24,11 @@ func (s *Server) getRoomUpdates(w http.ResponseWriter, r *http.Request, room *st
 	}
 
 	var err error
+	userName, _ := s.userName(r) // may be empty
+	var enc roomEncoder = jsonRoomEncoder{w}
+	if !wantsJSON(r) {
+		enc = htmlRoomEncoder{w, userName, s.userRole(r), s.csrfToken(w, r)}
+	}
 
 	var since uint64
 	if last := r.Header.Get("Last-Event-Id"); last != "" {
@@ -33,8 +43,8 @@ func (s *Server) getRoomUpdates(w http.ResponseWriter, r *http.Request, room *st
 
 	// Subscribe to new posts and let the channel buffer hold them for us
 	// while we're catching up with everything already posted since.
-	newPosts := s.db.StreamRoom(room.ID)
-	defer s.db.CancelStream(newPosts)
+	events := s.db.StreamRoom(room.ID, s.Backpressure)
+	defer s.db.CancelStream(events)
 
 	var posts []*store.Post
 	if since > 0 {
@@ -49,55 +59,296 @@ func (s *Server) getRoomUpdates(w http.ResponseWriter, r *http.Request, room *st
 	// even if we don't have any events to send (yet).
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
 	f.Flush()
 
-	// Send any initial posts since.
-	var cutoff uint64
-	for _, post := range posts {
-		err = sendPost(w, post)
-		if err != nil {
-			reqLogf(r, "failed to send initial posts: %v", err)
-			return
-		}
-		cutoff = post.Serial
+	feed := newRoomFeed(s.db, r, room, since, enc)
+	if err := feed.sendFetched(posts); err != nil {
+		reqLogf(r, "failed to send initial posts: %v", err)
+		return
 	}
 	f.Flush()
+	markedRead := feed.cutoff
+	s.markStreamed(r, userName, room, &markedRead, feed.lastSent)
 
-	reqLogf(r, "start streaming posts (initial cutoff at %v)", cutoff)
+	reqLogf(r, "start streaming posts (initial cutoff at %v)", feed.cutoff)
 
 loop: // Send new posts as they arrive.
 	for {
-		var post *store.Post
+		var ev store.Event
+		var ok bool
 		select {
 		case <-ctx.Done(): // client closed connection
 			err = ctx.Err()
 			break loop
-		case post = <-newPosts:
+		case ev, ok = <-events:
 		}
-		if post == nil {
-			// The pump detaches listeners that are too slow to process
-			// their buffers, as well as on server shutdown.
+		if !ok {
+			// The pump may close the channel of a listener that is too slow
+			// to process its buffer; it also does so on server shutdown.
 			err = errors.New("DB abandoned listener")
 			break loop
 		}
-		if post.Serial <= cutoff {
-			// We already got this post from GetPosts.
-			reqLogf(r, "skip initial post %v", post.Serial)
-			continue loop
-		}
-		err = sendPost(w, post)
-		if err != nil {
+		if err = feed.handle(ctx, ev); err != nil {
 			break loop
 		}
 		f.Flush()
+		s.markStreamed(r, userName, room, &markedRead, feed.lastSent)
 	}
 	if err != nil {
 		reqLogf(r, "stop streaming posts: %v", err)
 	}
 }
 
+// roomFeed sends the posts of a room to a client in order, each exactly once,
+// whether they come from the DB (initially or after a resync)
+// or from the stream. Changes to posts may be sent more than once.
+type roomFeed struct {
+	db    store.Store
+	r     *http.Request // for logging
+	room  *store.Room
+	enc   roomEncoder
+	state store.RoomState // as last sent to the client
+	// Posts up to cutoff have been fetched from the DB, so we must skip them
+	// when they arrive from the stream. lastSent is the highest serial sent.
+	cutoff, lastSent uint64
+}
+
+// newRoomFeed returns a roomFeed for a client that has the posts in room
+// up to since. If since is 0, the client has just loaded the room page,
+// so it has the posts up to room.Serial, and a resync must not send it
+// the whole room.
+func newRoomFeed(db store.Store, r *http.Request, room *store.Room, since uint64, enc roomEncoder) *roomFeed {
+	if since == 0 {
+		since = room.Serial
+	}
+	return &roomFeed{
+		db: db, r: r, room: room, enc: enc, state: room.State,
+		cutoff: since, lastSent: since,
+	}
+}
+
+// sendFetched sends posts fetched from the DB with GetPostsSince.
+func (feed *roomFeed) sendFetched(posts []*store.Post) error {
+	for _, post := range posts {
+		if err := feed.enc.newPost(post); err != nil {
+			return err
+		}
+		feed.lastSent = post.Serial
+	}
+	feed.cutoff = feed.lastSent
+	return nil
+}
+
+// resyncWindow is how many of the latest posts that the client has
+// are sent again on a resync, in case they have changed.
+const resyncWindow = 100
+
+// resync sends the client everything it may have missed because
+// events were dropped: the room, the latest posts it has (there's
+// no telling which of them were edited, deleted or reacted to),
+// and new posts, which are caught up with as the initial ones.
+func (feed *roomFeed) resync(ctx context.Context) error {
+	room, err := feed.db.GetRoom(ctx, feed.room.ID)
+	if err != nil {
+		return err
+	}
+	if room == nil {
+		return store.ErrNotFound
+	}
+	feed.room = room
+	err = feed.enc.updatedRoom(room, room.State != feed.state)
+	feed.state = room.State
+	if err != nil {
+		return err
+	}
+
+	var since uint64
+	if feed.lastSent > resyncWindow {
+		since = feed.lastSent - resyncWindow
+	}
+	posts, err := feed.db.GetPostsSince(ctx, room, since, 0)
+	if err != nil {
+		return err
+	}
+	for len(posts) > 0 && posts[0].Serial <= feed.lastSent {
+		if err := feed.enc.changedPost(changeOf(posts[0]), posts[0]); err != nil {
+			return err
+		}
+		posts = posts[1:]
+	}
+	return feed.sendFetched(posts)
+}
+
+// changeOf returns the type of event that brings a client up to date
+// with post, whatever has happened to it: edited and deleted posts must be
+// refetched as a whole, others may only have had their reactions changed.
+func changeOf(post *store.Post) store.EventType {
+	switch {
+	case !post.Deleted.IsZero():
+		return store.PostDeleted
+	case !post.Edited.IsZero():
+		return store.PostEdited
+	default:
+		return store.PostReacted
+	}
+}
+
+// handle sends whatever the client needs to know about ev.
+func (feed *roomFeed) handle(ctx context.Context, ev store.Event) error {
+	switch ev.Type {
+	case store.Resync:
+		// We were too slow, and some events have been dropped
+		// from the buffer.
+		reqLogf(feed.r, "resync after %v", feed.lastSent)
+		return feed.resync(ctx)
+
+	case store.PostEdited, store.PostDeleted, store.PostReacted:
+		// The client already has (or will soon get) this post.
+		return feed.enc.changedPost(ev.Type, ev.Post)
+
+	case store.RoomUpdated:
+		err := feed.enc.updatedRoom(ev.Room, ev.Room.State != feed.state)
+		feed.state = ev.Room.State
+		return err
+
+	default:
+		post := ev.Post
+		if post.Serial <= feed.cutoff {
+			// We already got this post from GetPostsSince.
+			reqLogf(feed.r, "skip fetched post %v", post.Serial)
+			return nil
+		}
+		if err := feed.enc.newPost(post); err != nil {
+			return err
+		}
+		if post.Serial > feed.lastSent {
+			feed.lastSent = post.Serial
+		}
+		return nil
+	}
+}
+
+// markStreamed moves userName's read marker in room to lastSent,
+// if it's past markedRead, which is then updated.
+func (s *Server) markStreamed(
+	r *http.Request, userName string, room *store.Room,
+	markedRead *uint64, lastSent uint64,
+) {
+	if userName == "" || lastSent <= *markedRead {
+		return
+	}
+	if err := s.db.MarkRead(r.Context(), userName, room.ID, lastSent); err != nil {
+		reqLogf(r, "failed to mark read: %v", err)
+		return
+	}
+	*markedRead = lastSent
+}
+
+// roomEncoder writes the events of a roomFeed to the client in some format.
+// Only new posts carry their serial number as a message ID,
+// which the client sends back (as Last-Event-Id or since) when it reconnects.
+type roomEncoder interface {
+	newPost(post *store.Post) error
+	changedPost(typ store.EventType, post *store.Post) error
+	updatedRoom(room *store.Room, stateChanged bool) error
+}
+
+// htmlRoomEncoder sends posts as HTML fragments for intercooler in
+// text/event-stream messages, as seen by user with the CSRF token.
+type htmlRoomEncoder struct {
+	w    io.Writer
+	user string
+	role store.Role
+	csrf string
+}
+
+func (enc htmlRoomEncoder) newPost(post *store.Post) error {
+	return sendPost(enc.w, postView{post, enc.user, enc.role, enc.csrf})
+}
+
+// changedPost just tells the client to fetch the new version of post,
+// or only its reactions.
+func (enc htmlRoomEncoder) changedPost(typ store.EventType, post *store.Post) error {
+	if typ == store.PostReacted {
+		return sendChanged(enc.w, fmt.Sprintf("reactions%d", post.Serial))
+	}
+	return sendChanged(enc.w, fmt.Sprintf("post%d", post.Serial))
+}
+
+func (enc htmlRoomEncoder) updatedRoom(room *store.Room, stateChanged bool) error {
+	err := sendChanged(enc.w, "roominfo")
+	if err == nil && stateChanged {
+		err = sendChanged(enc.w, "postform")
+	}
+	return err
+}
+
+// jsonRoomEncoder sends posts and rooms as in the JSON API, in text/event-stream
+// messages with the event type "post" for new posts, "edited", "deleted"
+// or "reacted" for changed posts, and "room" for room updates.
+type jsonRoomEncoder struct {
+	w io.Writer
+}
+
+func (enc jsonRoomEncoder) newPost(post *store.Post) error {
+	_, err := fmt.Fprintf(enc.w, "id: %d\n", post.Serial)
+	if err != nil {
+		return err
+	}
+	return sendJSON(enc.w, "post", newAPIPost(post))
+}
+
+func (enc jsonRoomEncoder) changedPost(typ store.EventType, post *store.Post) error {
+	return sendJSON(enc.w, changedEventName(typ), newAPIPost(post))
+}
+
+func (enc jsonRoomEncoder) updatedRoom(room *store.Room, stateChanged bool) error {
+	return sendJSON(enc.w, "room", newAPIRoom(room))
+}
+
+// changedEventName returns "edited", "deleted" or "reacted" for typ.
+func changedEventName(typ store.EventType) string {
+	switch typ {
+	case store.PostDeleted:
+		return "deleted"
+	case store.PostReacted:
+		return "reacted"
+	default:
+		return "edited"
+	}
+}
+
+// wantsJSON reports whether the client asked for JSON events
+// with ?format=json or an Accept header that includes application/json.
+func wantsJSON(r *http.Request) bool {
+	if r.Form.Get("format") == "json" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(part)
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendJSON writes a text/event-stream message of type event with v as JSON.
+// JSON has no raw newlines, so it fits in a single data line.
+func sendJSON(w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
 // sendPost writes post to w as an HTML fragment in a text/event-stream message.
-func sendPost(w http.ResponseWriter, post *store.Post) error {
+func sendPost(w io.Writer, post postView) error {
 	_, err := fmt.Fprintf(w, "id: %d\ndata: ", post.Serial)
 	if err != nil {
 		return err
@@ -109,3 +360,12 @@ func sendPost(w http.ResponseWriter, post *store.Post) error {
 	_, err = w.Write([]byte{'\n', '\n'})
 	return err
 }
+
+// sendChanged writes a text/event-stream message that triggers the client
+// to reload the element with the given id (see the ic-trigger-on attributes
+// in templates). The message has no ID, so it doesn't affect where the client
+// resumes the stream.
+func sendChanged(w io.Writer, id string) error {
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", id, id)
+	return err
+}
@@ -0,0 +1,180 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/vfaronov/nnbb/store"
+)
+
+// recordingEncoder is a roomEncoder that records the serials of new posts,
+// the changes to posts (as "edited 1" etc.) and the updated rooms.
+type recordingEncoder struct {
+	serials []uint64
+	changes []string
+	rooms   []*store.Room
+}
+
+func (enc *recordingEncoder) newPost(post *store.Post) error {
+	enc.serials = append(enc.serials, post.Serial)
+	return nil
+}
+
+func (enc *recordingEncoder) changedPost(typ store.EventType, post *store.Post) error {
+	enc.changes = append(enc.changes, fmt.Sprintf("%s %d", changedEventName(typ), post.Serial))
+	return nil
+}
+
+func (enc *recordingEncoder) updatedRoom(room *store.Room, stateChanged bool) error {
+	enc.rooms = append(enc.rooms, room)
+	return nil
+}
+
+// newTestRoom returns a room in db with n posts.
+func newTestRoom(t *testing.T, db store.Store, n int) *store.Room {
+	t.Helper()
+	ctx := context.Background()
+	room := &store.Room{Title: "test", Author: "alice"}
+	if err := db.CreateRoom(ctx, room); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		post := &store.Post{RoomID: room.ID, Author: "alice", Text: "hello"}
+		if err := db.CreatePost(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+	}
+	room, err := db.GetRoom(ctx, room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room
+}
+
+func TestRoomFeedResync(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		since      uint64
+		wantFirst  string // posts sent initially
+		wantResync string // posts sent on Resync after a new post
+	}{
+		// Without since, the client has all 30 posts from the page,
+		// and must not get the whole room again.
+		{0, "[]", "[31]"},
+		{25, "[26 27 28 29 30]", "[31]"},
+		{30, "[]", "[31]"},
+	}
+	for _, test := range tests {
+		_, db := newTestServer(t)
+		room := newTestRoom(t, db, 30)
+		r := newTestRequest(http.MethodGet, "/")
+		enc := &recordingEncoder{}
+		feed := newRoomFeed(db, r, room, test.since, enc)
+		var posts []*store.Post
+		if test.since > 0 {
+			var err error
+			if posts, err = db.GetPostsSince(ctx, room, test.since, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := feed.sendFetched(posts); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(enc.serials); got != test.wantFirst {
+			t.Errorf("since %d: initially sent %s, want %s", test.since, got, test.wantFirst)
+		}
+
+		enc.serials = nil
+		if err := feed.handle(ctx, store.Event{Type: store.Resync}); err != nil {
+			t.Fatal(err)
+		}
+		if len(enc.serials) > 0 {
+			t.Errorf("since %d: resync sent %v, want nothing", test.since, enc.serials)
+		}
+		post := &store.Post{RoomID: room.ID, Author: "alice", Text: "new"}
+		if err := db.CreatePost(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+		if err := feed.handle(ctx, store.Event{Type: store.Resync}); err != nil {
+			t.Fatal(err)
+		}
+		// The new post also comes from the stream, but is skipped.
+		if err := feed.handle(ctx, store.Event{Type: store.PostCreated, Post: post}); err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(enc.serials); got != test.wantResync {
+			t.Errorf("since %d: after resync sent %s, want %s", test.since, got, test.wantResync)
+		}
+	}
+}
+
+func TestRoomFeedSkipsPagePosts(t *testing.T) {
+	_, db := newTestServer(t)
+	room := newTestRoom(t, db, 3)
+	enc := &recordingEncoder{}
+	feed := newRoomFeed(db, newTestRequest(http.MethodGet, "/"), room, 0, enc)
+	// A post that was already on the page arrives late from the stream.
+	err := feed.handle(context.Background(), store.Event{
+		Type: store.PostCreated,
+		Post: &store.Post{RoomID: room.ID, Serial: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.serials) > 0 {
+		t.Errorf("sent %v, want nothing", enc.serials)
+	}
+}
+
+func TestRoomFeedResyncChanges(t *testing.T) {
+	ctx := context.Background()
+	_, db := newTestServer(t)
+	room := newTestRoom(t, db, resyncWindow+3)
+	enc := &recordingEncoder{}
+	feed := newRoomFeed(db, newTestRequest(http.MethodGet, "/"), room, 0, enc)
+
+	// While the client lags, changes to its posts and the room are dropped.
+	last := room.Serial
+	for _, change := range []func(post *store.Post) error{
+		func(post *store.Post) error { return db.EditPost(ctx, post, "bob", "edited") },
+		func(post *store.Post) error { return db.DeletePost(ctx, post, "bob") },
+		func(post *store.Post) error {
+			_, err := db.ToggleReaction(ctx, post, "bob", "👍")
+			return err
+		},
+	} {
+		post, err := db.GetPost(ctx, room, last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := change(post); err != nil {
+			t.Fatal(err)
+		}
+		last--
+	}
+	if err := db.SetRoomState(ctx, room, store.RoomLocked); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := feed.handle(ctx, store.Event{Type: store.Resync}); err != nil {
+		t.Fatal(err)
+	}
+	if len(enc.rooms) != 1 || enc.rooms[0].State != store.RoomLocked {
+		t.Errorf("sent rooms %+v, want the locked room", enc.rooms)
+	}
+	if len(enc.changes) != resyncWindow {
+		t.Fatalf("sent %d changes, want %d", len(enc.changes), resyncWindow)
+	}
+	// The posts that didn't change at all are sent as reacted,
+	// which costs the least to refetch.
+	got := fmt.Sprint(enc.changes[0], enc.changes[len(enc.changes)-3:])
+	want := fmt.Sprintf("reacted 4[reacted %d deleted %d edited %d]", room.Serial-2, room.Serial-1, room.Serial)
+	if got != want {
+		t.Errorf("sent changes %s, want %s", got, want)
+	}
+	if len(enc.serials) > 0 {
+		t.Errorf("sent new posts %v, want none", enc.serials)
+	}
+}
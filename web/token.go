@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// API clients that can't keep cookies authenticate with a token instead,
+// which they get from POST /api/v1/session/ and send in the Authorization
+// header as "Bearer <token>". Like session cookies, tokens are signed with
+// the server's key and can't be revoked, only expire.
+const (
+	tokenName   = "api-token" // keeps session cookies from passing as tokens
+	tokenMaxAge = 30 * 24 * time.Hour
+)
+
+func newTokenCodec(key []byte) *securecookie.SecureCookie {
+	return securecookie.New(key, nil).MaxAge(int(tokenMaxAge / time.Second))
+}
+
+// bearerToken returns the token from the Authorization header of r, if any.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// newToken returns a token that authenticates userName.
+func (s *Server) newToken(userName string) (string, error) {
+	return s.tokens.Encode(tokenName, userName)
+}
+
+// tokenUser returns the user name authenticated by token,
+// or false if token is invalid or expired.
+func (s *Server) tokenUser(token string) (string, bool) {
+	var userName string
+	if err := s.tokens.Decode(tokenName, token, &userName); err != nil {
+		return "", false
+	}
+	return userName, true
+}
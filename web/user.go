@@ -20,7 +20,12 @@ func (s *Server) session(r *http.Request) *sessions.Session {
 	return sess
 }
 
+// userName returns the name of the user authenticated by the token in r
+// or, if there's none, by the session.
 func (s *Server) userName(r *http.Request) (string, bool) {
+	if token := bearerToken(r); token != "" {
+		return s.tokenUser(token)
+	}
 	name, ok := s.session(r).Values["name"].(string)
 	return name, ok
 }
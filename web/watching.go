@@ -0,0 +1,181 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/vfaronov/nnbb/store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var watchingTpl = loadPageTemplate("watching.html")
+
+type watchingPayload struct {
+	Rooms  []*store.Room
+	Unread map[primitive.ObjectID]*unread
+}
+
+func (s *Server) getWatching(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Redirect(w, r, "/signup/?redir=/watching/", http.StatusSeeOther)
+		return
+	}
+	rooms, err := s.db.GetWatchedRooms(r.Context(), userName)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get watched rooms")
+		return
+	}
+	s.renderPage(w, r, watchingTpl, watchingPayload{
+		Rooms:  rooms,
+		Unread: s.getUnread(r, userName, rooms),
+	})
+}
+
+// getWatchedRoom renders the entry for room on the /watching/ page.
+func (s *Server) getWatchedRoom(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusForbidden)
+		return
+	}
+	rooms := []*store.Room{room}
+	s.renderFragment(w, r, watchingTpl, "watched", watchingPayload{
+		Rooms:  rooms,
+		Unread: s.getUnread(r, userName, rooms),
+	})
+}
+
+func (s *Server) postWatch(w http.ResponseWriter, r *http.Request, room *store.Room) {
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusForbidden)
+		return
+	}
+	watch := r.Form.Get("action") != "unwatch"
+	if err := s.db.SetWatching(r.Context(), userName, room.ID, watch); err != nil {
+		reqFatalf(w, r, err, "failed to update watched rooms")
+		return
+	}
+	if isXHR(r) {
+		s.renderFragment(w, r, roomTpl, "watchform",
+			roomPayload{Room: room, Watching: watch})
+	} else {
+		http.Redirect(w, r, "../", http.StatusSeeOther)
+	}
+}
+
+// isWatching reports whether userName watches room. Failures are only logged.
+func (s *Server) isWatching(r *http.Request, userName string, room *store.Room) bool {
+	watching, err := s.db.IsWatching(r.Context(), userName, room.ID)
+	if err != nil {
+		reqLogf(r, "failed to check watched room: %v", err)
+		return false
+	}
+	return watching
+}
+
+// getWatchingUpdates streams activity in all rooms that the user watches.
+// Each new post is sent as an "activity" fragment, followed by an event
+// that triggers the client to reload the room's entry.
+// Rooms that the user starts watching after opening the stream
+// are not included.
+func (s *Server) getWatchingUpdates(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+	f, ok := w.(http.Flusher)
+	if !ok {
+		reqLogf(r, "cannot stream events to %T", w)
+		http.Error(w, "cannot stream events", http.StatusNotImplemented)
+		return
+	}
+	userName, ok := s.userName(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusForbidden)
+		return
+	}
+
+	rooms, err := s.db.GetWatchedRooms(ctx, userName)
+	if err != nil {
+		reqFatalf(w, r, err, "failed to get watched rooms")
+		return
+	}
+	byID := make(map[primitive.ObjectID]*store.Room, len(rooms))
+	ids := make([]primitive.ObjectID, len(rooms))
+	for i, room := range rooms {
+		byID[room.ID] = room
+		ids[i] = room.ID
+	}
+	events := s.db.StreamRooms(ids, s.Backpressure)
+	defer s.db.CancelStream(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	f.Flush()
+
+	reqLogf(r, "start streaming activity in %d rooms", len(rooms))
+
+loop:
+	for {
+		var ev store.Event
+		var ok bool
+		select {
+		case <-ctx.Done(): // client closed connection
+			err = ctx.Err()
+			break loop
+		case ev, ok = <-events:
+		}
+		if !ok {
+			err = errors.New("DB abandoned listener")
+			break loop
+		}
+		switch ev.Type {
+		case store.PostCreated:
+			room := byID[ev.Post.RoomID]
+			err = sendActivity(w, room, ev.Post)
+			if err == nil {
+				err = sendChanged(w, "watched"+room.ID.Hex())
+			}
+
+		case store.RoomUpdated:
+			byID[ev.Room.ID] = ev.Room
+			err = sendChanged(w, "watched"+ev.Room.ID.Hex())
+
+		case store.Resync:
+			// We can't tell what activity we have missed,
+			// but we can at least bring all entries up to date.
+			for _, id := range ids {
+				if err = sendChanged(w, "watched"+id.Hex()); err != nil {
+					break
+				}
+			}
+
+		default:
+			continue loop
+		}
+		if err != nil {
+			break loop
+		}
+		f.Flush()
+	}
+	reqLogf(r, "stop streaming activity: %v", err)
+}
+
+// sendActivity writes an HTML fragment about post in room
+// in a text/event-stream message.
+func sendActivity(w http.ResponseWriter, room *store.Room, post *store.Post) error {
+	_, err := w.Write([]byte("data: "))
+	if err != nil {
+		return err
+	}
+	err = watchingTpl.ExecuteTemplate(dataWriter{w}, "activity",
+		struct {
+			Room *store.Room
+			Post *store.Post
+		}{room, post})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{'\n', '\n'})
+	return err
+}